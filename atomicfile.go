@@ -0,0 +1,310 @@
+package fullfile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	atomicTempInfix = ".tmp-"
+	atomicOldInfix  = ".old-"
+)
+
+// AtomicFile is a file that is changed atomically. All writes go to a temporary sibling file, which replaces the
+// original on Sync and Close if it has been modified. The superseded original is wiped. Readers of the original
+// always see a complete version. Every Sync copies the file, so it is best suited for small files. The temporary file
+// is locked while in use, so that opening the file again does not remove it, see cleanupReplace.
+// AtomicFile is safe for concurrent use.
+type AtomicFile struct {
+	mu    sync.Mutex
+	path  string
+	perm  os.FileMode
+	temp  *os.File // the temporary file that receives all writes.
+	dirty bool     // temp has been modified.
+}
+
+// OpenAtomicFile opens the file at path for atomic changes. The file is created with perm on the first Sync if it
+// does not exist. Stale temporary files of previous sessions are wiped and removed.
+func OpenAtomicFile(path string, perm os.FileMode) (*AtomicFile, error) {
+	f := &AtomicFile{
+		path: path,
+		perm: perm,
+	}
+	if err := cleanupReplace(f.path); err != nil {
+		return nil, err
+	}
+	if err := f.newTemp(0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// cleanupReplace removes the temporary files of interrupted replacements of the file at path, see replaceFile. If
+// the file is missing, because a replacement was interrupted after moving it aside, it is restored. Files moved aside
+// are wiped, unless they are hard links to the file itself, because the replacement was interrupted before the
+// rename; these are only removed. Temporary files that are locked are still in use by another AtomicFile or LogFile
+// and are skipped, see createTemp. Where locking is not supported, all temporary files are skipped.
+func cleanupReplace(path string) error {
+	old, err := filepath.Glob(path + atomicOldInfix + "*")
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) && len(old) == 1 {
+		if err := os.Rename(old[0], path); err != nil {
+			return err
+		}
+		old = nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	temp, err := filepath.Glob(path + atomicTempInfix + "*")
+	if err != nil {
+		return err
+	}
+	for _, name := range old {
+		if ofi, err := os.Stat(name); err == nil && fi != nil && os.SameFile(fi, ofi) {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := wipeFile(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range temp {
+		if err := wipeTemp(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTemp creates a temporary file in the directory of path, named with atomicTempInfix, with permissions perm. It
+// is locked until it is closed, if supported.
+func createTemp(path string, perm os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	temp, err := os.CreateTemp(dir, base+atomicTempInfix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err := temp.Chmod(perm); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	if _, err := tryFlock(temp, true); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return temp, nil
+}
+
+// wipeTemp wipes and removes the temporary file name, unless it is locked or locking is not supported.
+func wipeTemp(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if locked, err := tryFlock(f, true); !locked {
+		f.Close()
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		return err
+	}
+	return wipeOpenFile(f)
+}
+
+// newTemp creates a new temporary file as a copy of the original and seeks it to pos.
+func (f *AtomicFile) newTemp(pos int64) error {
+	temp, err := createTemp(f.path, f.perm)
+	if err != nil {
+		return err
+	}
+	if orig, err := os.Open(f.path); err == nil {
+		_, err = io.Copy(temp, orig)
+		orig.Close()
+		if err != nil {
+			wipeOpenFile(temp)
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		wipeOpenFile(temp)
+		return err
+	}
+	if _, err := temp.Seek(pos, io.SeekStart); err != nil {
+		wipeOpenFile(temp)
+		return err
+	}
+	f.temp = temp
+	return nil
+}
+
+// commit replaces the original with the temporary file.
+func (f *AtomicFile) commit() error {
+	return replaceFile(f.path, f.temp)
+}
+
+// replaceFile replaces the file at path with temp, a temporary file in the same directory named with
+// atomicTempInfix, by renaming temp over path. The rename is atomic: readers of path see either the original or temp.
+// Before, the original is hard linked aside, so that its content can still be wiped once it has been replaced. If
+// hard links are not supported, it is renamed aside instead, and cleanupReplace restores it if the rename of temp
+// does not happen. temp stays open and refers to path afterwards.
+func replaceFile(path string, temp *os.File) error {
+	if err := temp.Sync(); err != nil {
+		return err
+	}
+	dir, base := filepath.Split(path)
+	old := ""
+	if _, err := os.Stat(path); err == nil {
+		tmp, err := os.CreateTemp(dir, base+atomicOldInfix+"*")
+		if err != nil {
+			return err
+		}
+		old = tmp.Name()
+		tmp.Close()
+		os.Remove(old)
+		if err := os.Link(path, old); err != nil {
+			if err := os.Rename(path, old); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if old != "" {
+		return wipeFile(old)
+	}
+	return nil
+}
+
+// syncDir flushes the directory entries of dir to stable storage.
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// wipeFile overwrites the file with random data and removes it.
+func wipeFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return wipeOpenFile(f)
+}
+
+// wipeOpenFile overwrites f with random data, closes and removes it. Wiping through f keeps a lock on it until the
+// data is gone.
+func wipeOpenFile(f *os.File) error {
+	size, err := fileSize(f)
+	if err == nil {
+		err = wipeRange(context.Background(), f, 0, size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
+
+// Read reads from the temporary file.
+func (f *AtomicFile) Read(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.temp.Read(p)
+}
+
+// ReadAt reads from the temporary file at offset off.
+func (f *AtomicFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.temp.ReadAt(p, off)
+}
+
+// Write writes to the temporary file.
+func (f *AtomicFile) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirty = true
+	return f.temp.Write(p)
+}
+
+// WriteAt writes to the temporary file at offset off.
+func (f *AtomicFile) WriteAt(p []byte, off int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirty = true
+	return f.temp.WriteAt(p, off)
+}
+
+// Seek sets the seek position of the temporary file.
+func (f *AtomicFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.temp.Seek(offset, whence)
+}
+
+// Truncate changes the size of the temporary file.
+func (f *AtomicFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirty = true
+	return f.temp.Truncate(size)
+}
+
+// Sync replaces the original with the current content and continues with a new temporary copy.
+func (f *AtomicFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return nil
+	}
+	pos, err := f.temp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := f.commit(); err != nil {
+		return err
+	}
+	f.temp.Close()
+	f.dirty = false
+	return f.newTemp(pos)
+}
+
+// Close replaces the original with the current content, if modified. Otherwise the temporary file is wiped.
+func (f *AtomicFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return wipeOpenFile(f.temp)
+	}
+	err := f.commit()
+	if cerr := f.temp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
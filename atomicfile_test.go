@@ -0,0 +1,132 @@
+package fullfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault")
+	stale := path + atomicTempInfix + "123"
+	if err := ioutil.WriteFile(stale, []byte("stale"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	transform := new(TestTransform)
+	bfile, err := OpenBlockFile(path, transform, &OpenOptions{Atomic: true})
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale file not removed: %v", err)
+	}
+	if err := bfile.WriteBlock([]byte("Test Block 001")); err != nil {
+		t.Fatalf("WriteBlock: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("File created before Sync: %v", err)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if len(d) != transform.HeaderSize()+transform.BlockSize() || !bytes.Contains(d, []byte("Test Block 001")) {
+		t.Errorf("False data after Sync: %q", d)
+	}
+	if err := bfile.WriteBlock([]byte("Test Block 002")); err != nil {
+		t.Fatalf("WriteBlock: %s", err)
+	}
+	if d2, _ := ioutil.ReadFile(path); !bytes.Equal(d, d2) {
+		t.Error("File changed before Close")
+	}
+	if err := bfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if d, _ := ioutil.ReadFile(path); !bytes.Contains(d, []byte("Test Block 002")) {
+		t.Errorf("False data after Close: %q", d)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("Temporary files left: %v", files)
+	}
+}
+
+func TestAtomicFileRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault")
+	if err := ioutil.WriteFile(path+atomicOldInfix+"123", []byte("original"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	f, err := OpenAtomicFile(path, 0600)
+	if err != nil {
+		t.Fatalf("OpenAtomicFile: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if d, _ := ioutil.ReadFile(path); string(d) != "original" {
+		t.Errorf("Original not restored: %q", d)
+	}
+}
+
+func TestAtomicFileInterruptedLink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault")
+	if err := ioutil.WriteFile(path, []byte("current"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	// A crash between linking the original aside and renaming leaves a hard link to the current file
+	old := path + atomicOldInfix + "123"
+	if err := os.Link(path, old); err != nil {
+		t.Skipf("Link: %s", err)
+	}
+	f, err := OpenAtomicFile(path, 0600)
+	if err != nil {
+		t.Fatalf("OpenAtomicFile: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if d, _ := ioutil.ReadFile(path); string(d) != "current" {
+		t.Errorf("Current file wiped: %q", d)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Link not removed: %v", err)
+	}
+}
+
+// TestAtomicFileInUse opens the file a second time while the temporary file of the first open is in use.
+func TestAtomicFileInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	first, err := OpenAtomicFile(path, 0600)
+	if err != nil {
+		t.Fatalf("OpenAtomicFile: %s", err)
+	}
+	if _, err := first.Write([]byte("first")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	second, err := OpenAtomicFile(path, 0600)
+	if err != nil {
+		t.Fatalf("OpenAtomicFile: %s", err)
+	}
+	if _, err := os.Stat(first.temp.Name()); err != nil {
+		t.Errorf("Temporary file in use removed: %s", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if d, _ := ioutil.ReadFile(path); string(d) != "first" {
+		t.Errorf("False data: %q", d)
+	}
+	if files, _ := filepath.Glob(path + ".*"); len(files) != 0 {
+		t.Errorf("Temporary files left: %v", files)
+	}
+}
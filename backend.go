@@ -0,0 +1,106 @@
+package fullfile
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+)
+
+// readFullAt reads len(p) bytes at offset off from f, using io.ReaderAt if available. It returns io.EOF if no bytes
+// could be read and io.ErrUnexpectedEOF if fewer than len(p) bytes could be read. Without io.ReaderAt, the seek
+// position of f is changed.
+func readFullAt(f io.ReadSeeker, p []byte, off int64) (int, error) {
+	var n int
+	var err error
+	if ra, ok := f.(io.ReaderAt); ok {
+		n, err = ra.ReadAt(p, off)
+	} else {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err = io.ReadFull(f, p)
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// writeFullAt writes p at offset off to f, using io.WriterAt if available. Without io.WriterAt, the seek position of
+// f is changed.
+func writeFullAt(f io.WriteSeeker, p []byte, off int64) (int, error) {
+	if wa, ok := f.(io.WriterAt); ok {
+		return wa.WriteAt(p, off)
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := f.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// fileSize returns the size of f. The seek position of f is changed to its end.
+func fileSize(f io.Seeker) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
+
+// wipeRange overwrites f from start up to end with random data and flushes it to stable storage, if supported. It
+// stops with the error of ctx if ctx is done before a chunk is written.
+func wipeRange(ctx context.Context, f io.WriteSeeker, start, end int64) error {
+	r := make([]byte, 32*1024)
+	for pos := start; pos < end; pos += int64(len(r)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := overwriteRange(f, pos, min64(pos+int64(len(r)), end), r); err != nil {
+			return err
+		}
+	}
+	if s, ok := f.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// overwriteRange overwrites f from start up to end with random data, using r as buffer.
+func overwriteRange(f io.WriteSeeker, start, end int64, r []byte) error {
+	for pos := start; pos < end; pos += int64(len(r)) {
+		if end-pos < int64(len(r)) {
+			r = r[:end-pos]
+		}
+		if _, err := io.ReadFull(rand.Reader, r); err != nil {
+			return err
+		}
+		if _, err := writeFullAt(f, r, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contextReader is an io.Reader that fails with the error of ctx once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read reads from the underlying reader, unless ctx is done.
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// chunkSpan returns the chunk of chunkSize bytes that contains offset off, the position of off in the chunk and the
+// length of the part of n bytes at off that lies in the chunk.
+func chunkSpan(off, n, chunkSize int64) (chunk, pos, l int64) {
+	chunk, pos = off/chunkSize, off%chunkSize
+	return chunk, pos, min64(n, chunkSize-pos)
+}
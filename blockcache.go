@@ -0,0 +1,124 @@
+package fullfile
+
+import (
+	"container/list"
+	"sort"
+)
+
+// DefaultCacheSize is the number of decrypted blocks a StreamFile caches by default.
+const DefaultCacheSize = 16
+
+// cacheEntry is a decrypted block held by a blockCache.
+type cacheEntry struct {
+	block int64
+	buf   *SecureBuffer // holds the decrypted block.
+	data  []byte        // the data of the block, within buf.
+	dirty bool          // data has been modified and must be written back.
+}
+
+// blockCache is a LRU cache of decrypted blocks. Cached data lives in SecureBuffers and is zeroed on eviction.
+type blockCache struct {
+	size    int                     // the maximum number of entries.
+	entries map[int64]*list.Element // block number to element of lru.
+	lru     *list.List              // entries, most recently used first.
+}
+
+func newBlockCache(size int) *blockCache {
+	if size < 1 {
+		size = 1
+	}
+	return &blockCache{
+		size:    size,
+		entries: make(map[int64]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the entry for block and marks it as recently used, or nil if block is not cached.
+func (c *blockCache) get(block int64) *cacheEntry {
+	if e, ok := c.entries[block]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+// peek returns the entry for block without marking it as recently used, or nil if block is not cached.
+func (c *blockCache) peek(block int64) *cacheEntry {
+	if e, ok := c.entries[block]; ok {
+		return e.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+// full returns true if adding an entry requires eviction.
+func (c *blockCache) full() bool {
+	return c.lru.Len() >= c.size
+}
+
+// oldest returns the least recently used entry, or nil if the cache is empty.
+func (c *blockCache) oldest() *cacheEntry {
+	if e := c.lru.Back(); e != nil {
+		return e.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+// remove removes entry from the cache and zeroes its data. The buffer is returned for reuse.
+func (c *blockCache) remove(entry *cacheEntry) *SecureBuffer {
+	if e, ok := c.entries[entry.block]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, entry.block)
+	}
+	clear(entry.buf.Bytes())
+	entry.data = nil
+	return entry.buf
+}
+
+// replace reuses entry for block, with data held by buf, and marks it as the most recently used. The data of entry
+// is zeroed and its previous buffer returned for reuse. Unlike remove and add, replace does not allocate.
+func (c *blockCache) replace(entry *cacheEntry, block int64, buf *SecureBuffer, data []byte) *SecureBuffer {
+	old := entry.buf
+	clear(old.Bytes())
+	e := c.entries[entry.block]
+	delete(c.entries, entry.block)
+	c.entries[block] = e
+	c.lru.MoveToFront(e)
+	entry.block, entry.buf, entry.data, entry.dirty = block, buf, data, false
+	return old
+}
+
+// add adds entry to the cache as the most recently used. The caller must evict first if the cache is full.
+func (c *blockCache) add(entry *cacheEntry) {
+	c.entries[entry.block] = c.lru.PushFront(entry)
+}
+
+// all returns all entries, most recently used first.
+func (c *blockCache) all() []*cacheEntry {
+	r := make([]*cacheEntry, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		r = append(r, e.Value.(*cacheEntry))
+	}
+	return r
+}
+
+// dirty returns all dirty entries, ordered by block number.
+func (c *blockCache) dirty() []*cacheEntry {
+	var r []*cacheEntry
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cacheEntry); entry.dirty {
+			r = append(r, entry)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].block < r[j].block })
+	return r
+}
+
+// destroy removes all entries and destroys their buffers.
+func (c *blockCache) destroy() {
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*cacheEntry).buf.Destroy()
+	}
+	c.entries = make(map[int64]*list.Element)
+	c.lru.Init()
+}
@@ -0,0 +1,80 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+type countTransform struct {
+	TestTransform
+	reads, writes atomic.Int64
+}
+
+func (ttf *countTransform) ReadBlock(n int64, block []byte) ([]byte, error) {
+	ttf.reads.Add(1)
+	return ttf.TestTransform.ReadBlock(n, block)
+}
+
+func (ttf *countTransform) WriteBlock(n int64, data []byte) ([]byte, error) {
+	ttf.writes.Add(1)
+	return ttf.TestTransform.WriteBlock(n, data)
+}
+
+func TestStreamFileCache(t *testing.T) {
+	transform := new(countTransform)
+	file := NewMemFile()
+	defer file.Close()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	if err := sfile.SetCacheSize(2); err != nil {
+		t.Fatalf("SetCacheSize: %s", err)
+	}
+	d := make([]byte, 32*5)
+	for i := range d {
+		d[i] = byte(i)
+	}
+	// Bytewise writes, evicting dirty blocks
+	for i := range d {
+		if _, err := sfile.Write(d[i : i+1]); err != nil {
+			t.Fatalf("Write %d: %s", i, err)
+		}
+	}
+	if transform.writes.Load() != 3 {
+		t.Errorf("Evicted block writes: %d!=%d", transform.writes.Load(), 3)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if transform.writes.Load() != 5 {
+		t.Errorf("Synced block writes: %d!=%d", transform.writes.Load(), 5)
+	}
+	// Bytewise reads, decrypting every block only once
+	sfile.Seek(0, io.SeekStart)
+	td := make([]byte, len(d))
+	for i := range td {
+		if _, err := sfile.Read(td[i : i+1]); err != nil {
+			t.Fatalf("Read %d: %s", i, err)
+		}
+	}
+	if !bytes.Equal(td, d) {
+		t.Errorf("False data:\n\t%x\n\t%x", d, td)
+	}
+	if transform.reads.Load() != 5 {
+		t.Errorf("Block reads: %d!=%d", transform.reads.Load(), 5)
+	}
+	if _, err := sfile.Read(td[:1]); err != io.EOF {
+		t.Errorf("Read past end: %v", err)
+	}
+	entry := sfile.cache.oldest()
+	if err := sfile.SetCacheSize(1); err != nil {
+		t.Fatalf("SetCacheSize: %s", err)
+	}
+	if entry.buf.Bytes() != nil {
+		t.Error("Evicted buffer not destroyed")
+	}
+}
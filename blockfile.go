@@ -1,8 +1,12 @@
 package fullfile
 
 import (
+	"context"
 	"errors"
 	"io"
+	"os"
+	"sort"
+	"sync"
 )
 
 /*
@@ -28,7 +32,8 @@ type ReadWriteCloseSeeker interface {
 	Write(p []byte) (n int, err error)
 }
 
-// Transform transforms blocks of data and defines the data format of a BlockFile
+// Transform transforms blocks of data and defines the data format of a BlockFile.
+// ReadBlock and WriteBlock may be called concurrently for different blocks and must be safe for concurrent use.
 type Transform interface {
 	// Size of the header
 	HeaderSize() int
@@ -41,52 +46,198 @@ type Transform interface {
 	// SyncHeader is called on synchronizing the file and returns the new header,
 	// or nil if the header is not changed. Can return ErrFullReadRequired.
 	SyncHeader() ([]byte, error)
-	// Called when reading a block. The block given contains prefix and postfix.
+	// Called when reading a block. The block given contains prefix and postfix. To avoid allocations, the data
+	// should be transformed in place and returned as a slice of block.
 	ReadBlock(n int64, block []byte) ([]byte, error)
 	// Called when writing a block. The data is given without prefix and postfix,
-	// the returned block must contain both.
+	// the returned block must contain both. It must not consist of zero bytes only, which marks holes.
 	WriteBlock(n int64, data []byte) ([]byte, error)
 	// FullRead is called when SyncHeader or Init return ErrFullReadRequired. It can be used to re-calculate the header.
 	// It must return the new header or nil.
 	FullRead(r io.Reader) ([]byte, error)
 }
 
+// InPlaceTransform can be implemented by a Transform that writes blocks into buffers provided by the BlockFile,
+// which then writes blocks without allocating. WriteBlockTo transforms data like WriteBlock, writes the block to dst,
+// which has a length of BlockSize(), and returns it.
+type InPlaceTransform interface {
+	WriteBlockTo(n int64, dst, data []byte) ([]byte, error)
+}
+
+// InPlaceReader can be implemented by a Transform that reads blocks into buffers provided by the BlockFile, so that
+// data is not copied after decryption. ReadBlockTo transforms block like ReadBlock, writes the data to dst, which has
+// a length of DataSize(), and returns it. block must not be changed.
+type InPlaceReader interface {
+	ReadBlockTo(n int64, dst, block []byte) ([]byte, error)
+}
+
+// ContextFullReader can be implemented by a Transform whose FullRead takes long. FullReadContext is called instead of
+// FullRead and should return ctx.Err() as soon as ctx is done, leaving the transform unchanged.
+type ContextFullReader interface {
+	FullReadContext(ctx context.Context, r io.Reader) ([]byte, error)
+}
+
+// Layouter can be implemented by a Transform to define the layout of the file, for example padding to align blocks
+// to sectors. The Interlay must describe a header of HeaderSize() bytes and slices of BlockSize() bytes. Without
+// Layouter, slices follow the header and each other without gaps.
+type Layouter interface {
+	Interlay() Interlay
+}
+
+// Truncater can be implemented by a Transform that keeps metadata about the blocks of the file, like their number
+// or an integrity root. Truncate is called after the file has been truncated to n blocks, before the header is synced.
+type Truncater interface {
+	Truncate(n int64) error
+}
+
+// HoleTracker can be implemented by a Transform to decide which blocks are holes, overriding the tracking of the
+// BlockFile. IsHole returns true if block n has never been written, or has been discarded by Truncate. Holes read as
+// zero data without calling ReadBlock, so IsHole should be based on authenticated state, for example a bitmap of
+// written blocks in the header that is updated by WriteBlock and Truncate. Without HoleTracker, a block that is stored
+// as zero bytes only is a hole, so that blocks zeroed in the underlying file by an attacker read as zero data as well.
+type HoleTracker interface {
+	IsHole(n int64) bool
+}
+
+// Generationer can be implemented by a Transform that stores a generation counter in its authenticated header.
+// SetGeneration is called with the incremented counter before the header is synced after blocks have been written.
+type Generationer interface {
+	Generation() uint64
+	SetGeneration(gen uint64)
+}
+
+// Lengther can be implemented by a Transform that stores the length of the data of a StreamFile in bytes in its
+// header, which is then not rounded up to whole blocks. Length returns the stored length, or -1 if there is none.
+// SetLength is called by the StreamFile whenever the length changes, before the header is synced.
+type Lengther interface {
+	Length() int64
+	SetLength(n int64)
+}
+
+// truncater is implemented by underlying files that can change their size, like *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// sizer is implemented by underlying files held in memory, like MmapFile and MemFile. Since all blocks are accessed
+// through io.ReaderAt and io.WriterAt, BlockFile neither seeks them for each block nor to determine their size.
+type sizer interface {
+	io.ReaderAt
+	io.WriterAt
+	Len() int64
+}
+
+// blockLockStripes is the number of per-block locks of a BlockFile. Block n uses lock n % blockLockStripes.
+const blockLockStripes = 64
+
 // BlockFile is a file that consists of blocks of data that have prefix and postfix. The file may have a header.
+//
+// BlockFile is safe for concurrent use. Operations on blocks (ReadBlockAt, WriteBlockAt and their seeking variants)
+// hold the file lock shared, and a per-block lock: shared for reading, exclusive for writing. Reads of any blocks
+// and writes of different blocks thus run in parallel, while a block being written is never read half-way.
+// Operations on the whole file (Sync, Truncate, Close) hold the file lock exclusively and wait for all block
+// operations to finish. The seek position is shared by all goroutines; concurrent users should use the At variants.
+//
+// A BlockFile opened by OpenBlockFile with OpenOptions.Lock holds an advisory lock for as long as it is open: shared
+// if opened read-only, exclusive otherwise. Other processes, and other opens in the same process, that use the lock
+// fail with ErrLocked, or wait for it with OpenBlockFileContext, until it is released by Close. If the transform is a
+// Generationer, every sync that writes changes increments a generation counter in the header, by which a process
+// detects changes made by others since it last had the file open, and a StreamFile detects changes made directly to
+// the BlockFile. See Generation.
+//
+// BlockFile supports sparse files. Blocks can be written past the end of the file. The blocks skipped are holes:
+// they are not stored and consist of zero bytes in the underlying file, and read as zero data without being
+// transformed. The BlockFile keeps track of the holes it creates, and takes blocks stored as zero bytes for holes
+// created before it was opened. A HoleTracker transform decides instead.
 type BlockFile struct {
 	headerSize int
 	blockSize  int
 	dataSize   int
 	blockPos   int64
 	numBlocks  int64
+	rw         sync.RWMutex                   // the file lock.
+	blockLocks [blockLockStripes]sync.RWMutex // the per-block locks.
+	mu         sync.Mutex                     // protects blockPos, numBlocks and the seek position of data. Acquired last.
+	bufs       sync.Pool                      // *[]byte buffers for transformed blocks.
+	flock      *fileLock                      // the lock shared with other processes, if any.
+	modified   bool                           // blocks have been changed since the header was synced.
+	holes      holeExtents                    // the holes created since the file was opened. Protected by mu.
+	readOnly   bool                           // writes are rejected and the header is never synced.
 	transform  Transform
-	// interlay   *Interlay
-	data ReadWriteCloseSeeker
+	interlay   *Interlay
+	data       ReadWriteCloseSeeker
 }
 
 // NewBlockFile treats rwsc as a BlockFile that transforms blocks via a transform.
 func NewBlockFile(f ReadWriteCloseSeeker, transform Transform) (*BlockFile, error) {
+	return newBlockFile(context.Background(), f, transform, blockFileConfig{})
+}
+
+// NewBlockFileContext is like NewBlockFile, but a full read requested by the transform is aborted when ctx is done.
+func NewBlockFileContext(ctx context.Context, f ReadWriteCloseSeeker, transform Transform) (*BlockFile, error) {
+	return newBlockFile(ctx, f, transform, blockFileConfig{})
+}
+
+// blockFileConfig holds the options of a BlockFile that are not defined by the transform.
+type blockFileConfig struct {
+	flock    *fileLock // the lock shared with other processes, if any.
+	readOnly bool      // the file is never written.
+	align    int64     // the alignment of the layout, if the transform does not define it.
+}
+
+// newBlockFile creates a BlockFile configured by cfg.
+func newBlockFile(ctx context.Context, f ReadWriteCloseSeeker, transform Transform, cfg blockFileConfig) (*BlockFile, error) {
+	if err := checkPanic(); err != nil {
+		return nil, err
+	}
 	r := &BlockFile{
 		headerSize: transform.HeaderSize(),
 		blockSize:  transform.BlockSize(),
 		dataSize:   transform.DataSize(),
+		flock:      cfg.flock,
+		readOnly:   cfg.readOnly,
 		transform:  transform,
 		data:       f,
 	}
-	// r.interlay = &Interlay{
-	// 	HeaderSize: int64(r.headerSize),
-	// 	DataSize:   int64(r.blockSize),
-	// }
-	if header, err := r.readHeader(); err != nil {
+	if l, ok := transform.(Layouter); ok {
+		in := l.Interlay()
+		r.interlay = &in
+	} else {
+		r.interlay = &Interlay{
+			HeaderSize: int64(r.headerSize),
+			DataSize:   int64(r.blockSize),
+		}
+	}
+	if r.interlay.Align == 0 {
+		r.interlay.Align = cfg.align
+	}
+	if err := r.interlay.Validate(); err != nil {
+		return nil, err
+	} else if r.interlay.HeaderSize != int64(r.headerSize) || r.interlay.SliceLen() != int64(r.blockSize) {
+		return nil, ErrInvalidInterlay
+	}
+	if err := r.init(ctx); err != nil {
 		return nil, err
-	} else if err := r.transform.Init(header); err != nil {
+	}
+	if err := register(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// init reads the header and initializes the transform with it.
+func (file *BlockFile) init(ctx context.Context) error {
+	if header, err := file.readHeader(); err != nil {
+		return err
+	} else if err := file.transform.Init(header); err != nil {
 		if err == ErrFullReadRequired {
-			_, err = r.fullRead()
+			_, err = file.fullRead(ctx)
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return r, r.seekBlock(0)
+	return file.seekBlock(0)
 }
 
 // BlockSize returns the blocksize of the underlying file.
@@ -99,13 +250,23 @@ func (file *BlockFile) DataSize() int {
 	return file.dataSize
 }
 
-func (file *BlockFile) fullRead() ([]byte, error) {
+// fullRead passes the data following the header to the FullRead method of the transform. It is aborted when ctx is
+// done: transforms implementing ContextFullReader get ctx, others get a reader that fails once ctx is done.
+func (file *BlockFile) fullRead(ctx context.Context) ([]byte, error) {
 	var d []byte
 	var err error
-	if _, err = file.data.Seek(int64(file.headerSize), io.SeekStart); err != nil {
+	if err = ctx.Err(); err != nil {
 		return nil, err
 	}
-	if d, err = file.transform.FullRead(file.data); err != nil {
+	if _, err = file.data.Seek(file.interlay.PayloadPosition(), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if t, ok := file.transform.(ContextFullReader); ok {
+		d, err = t.FullReadContext(ctx, file.data)
+	} else {
+		d, err = file.transform.FullRead(&contextReader{ctx: ctx, r: file.data})
+	}
+	if err != nil {
 		return nil, err
 	}
 	return d, file.seekBlock(0)
@@ -128,6 +289,9 @@ func (file *BlockFile) readHeader() ([]byte, error) {
 }
 
 func (file *BlockFile) writeHeader(d []byte) error {
+	if d == nil {
+		return nil
+	}
 	if _, err := file.data.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
@@ -136,41 +300,158 @@ func (file *BlockFile) writeHeader(d []byte) error {
 	}
 	if n, err := file.data.Write(d); err != nil {
 		return err
-	} else if n != file.headerSize {
-		return io.ErrShortBuffer
+	} else if n != len(d) {
+		return io.ErrShortWrite
 	}
 	return file.seekBlock(0)
 }
 
-func (file *BlockFile) syncHeader() error {
+func (file *BlockFile) syncHeader(ctx context.Context) error {
 	var header []byte
 	var err error
+	if g, ok := file.transform.(Generationer); ok && file.modified {
+		g.SetGeneration(g.Generation() + 1)
+	}
 	header, err = file.transform.SyncHeader()
 	if err != nil && err != ErrFullReadRequired {
 		return err
 	} else if err == ErrFullReadRequired {
-		if header, err = file.fullRead(); err != nil {
+		if header, err = file.fullRead(ctx); err != nil {
 			return err
 		}
 	}
-	return file.writeHeader(header)
+	if err := file.writeHeader(header); err != nil {
+		return err
+	}
+	file.modified = false
+	return nil
+}
+
+// Generation returns the generation counter stored in the header, or 0 if the transform is not a Generationer.
+func (file *BlockFile) Generation() uint64 {
+	if g, ok := file.transform.(Generationer); ok {
+		file.rw.RLock()
+		defer file.rw.RUnlock()
+		return g.Generation()
+	}
+	return 0
+}
+
+// blockLock returns the lock of block n.
+func (file *BlockFile) blockLock(n int64) *sync.RWMutex {
+	return &file.blockLocks[uint64(n)%blockLockStripes]
 }
 
-// Sync the file (writes header).
+// lockBlocks acquires the locks of count blocks from start on, exclusively if write is set, and returns a function
+// that releases them. Locks are acquired in stripe order.
+func (file *BlockFile) lockBlocks(start, count int64, write bool) func() {
+	var stripes []int
+	if count >= blockLockStripes {
+		stripes = make([]int, blockLockStripes)
+		for i := range stripes {
+			stripes[i] = i
+		}
+	} else {
+		for n := start; n < start+count; n++ {
+			stripes = append(stripes, int(uint64(n)%blockLockStripes))
+		}
+		sort.Ints(stripes)
+	}
+	for _, i := range stripes {
+		if write {
+			file.blockLocks[i].Lock()
+		} else {
+			file.blockLocks[i].RLock()
+		}
+	}
+	return func() {
+		for _, i := range stripes {
+			if write {
+				file.blockLocks[i].Unlock()
+			} else {
+				file.blockLocks[i].RUnlock()
+			}
+		}
+	}
+}
+
+// Sync the file (writes header and flushes the underlying file to stable storage, if supported). It does nothing for
+// read-only files.
 func (file *BlockFile) Sync() error {
-	return file.syncHeader()
+	return file.SyncContext(context.Background())
 }
 
-// Close the file.
+// SyncContext is like Sync, but a full read requested by the transform is aborted when ctx is done. The header is
+// then left unchanged. Backends with a SyncContext method, like Journal, get ctx as well.
+func (file *BlockFile) SyncContext(ctx context.Context) error {
+	if err := checkPanic(); err != nil {
+		return err
+	}
+	if file.readOnly {
+		return nil
+	}
+	file.rw.Lock()
+	defer file.rw.Unlock()
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if err := file.syncHeader(ctx); err != nil {
+		return err
+	}
+	return file.syncData(ctx)
+}
+
+// syncData flushes the underlying file, passing ctx if it supports SyncContext.
+func (file *BlockFile) syncData(ctx context.Context) error {
+	if s, ok := file.data.(contextSyncer); ok {
+		return s.SyncContext(ctx)
+	}
+	if s, ok := file.data.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close the file. The header is synced, unless the file is read-only. If closing fails, the file stays registered
+// for Panic.
 func (file *BlockFile) Close() error {
-	if err := file.syncHeader(); err != nil {
+	if err := checkPanic(); err != nil {
+		return err
+	}
+	file.rw.Lock()
+	err := file.close()
+	file.rw.Unlock()
+	if err != nil {
 		return err
 	}
+	unregister(file)
+	if file.flock != nil {
+		return file.flock.close()
+	}
+	return nil
+}
+
+// close syncs the header, destroys the transform and closes the underlying file. The file lock must be held
+// exclusively.
+func (file *BlockFile) close() error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if !file.readOnly {
+		if err := file.syncHeader(context.Background()); err != nil {
+			return err
+		}
+	}
+	if d, ok := file.transform.(Destroyer); ok {
+		d.Destroy()
+	}
 	return file.data.Close()
 }
 
 func (file *BlockFile) seekBlock(block int64) error {
-	if _, err := file.data.Seek(int64(int64(file.headerSize)+(int64(file.blockSize)*block)), io.SeekStart); err != nil {
+	if _, ok := file.data.(sizer); ok {
+		file.blockPos = block
+		return nil
+	}
+	if _, err := file.data.Seek(file.blockPosition(block), io.SeekStart); err != nil {
 		return err
 	}
 	file.blockPos = block
@@ -179,75 +460,482 @@ func (file *BlockFile) seekBlock(block int64) error {
 
 // ReadBlock reads a block and updates the seek position to the next block. d is reallocated if nil or smaller than BlockSize().
 func (file *BlockFile) ReadBlock(d []byte) ([]byte, error) {
-	var rb []byte
-	if err := file.seekBlock(file.blockPos); err != nil {
+	file.mu.Lock()
+	block := file.blockPos
+	file.mu.Unlock()
+	d, err := file.ReadBlockAt(block, d)
+	if err != nil {
 		return nil, err
 	}
+	file.mu.Lock()
+	file.blockPos = block + 1
+	file.mu.Unlock()
+	return d, nil
+}
+
+// ReadBlockAt reads block n without using or changing the seek position. d is reallocated if nil or smaller than
+// BlockSize(). Reads happen in parallel if the underlying file implements io.ReaderAt.
+func (file *BlockFile) ReadBlockAt(n int64, d []byte) ([]byte, error) {
+	if err := checkPanic(); err != nil {
+		return nil, err
+	}
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	l := file.blockLock(n)
+	l.RLock()
+	defer l.RUnlock()
+	return file.readBlockAt(n, d)
+}
+
+// readBlockAt reads block n. The caller must hold the locks.
+func (file *BlockFile) readBlockAt(n int64, d []byte) ([]byte, error) {
 	if d == nil || cap(d) < file.blockSize {
 		d = make([]byte, file.blockSize)
 	}
-	rb = d[0:file.blockSize]
-	n, err := file.data.Read(rb)
-	if err != nil {
-		file.seekBlock(file.blockPos)
+	if err := file.readAt(d[0:file.blockSize], n); err != nil {
 		return nil, err
 	}
-	if n < file.blockSize {
-		file.seekBlock(file.blockPos)
-		return nil, io.ErrShortBuffer
+	if file.isHole(n, d[0:file.blockSize]) {
+		clear(d[0:file.dataSize])
+		return d[0:file.dataSize], nil
 	}
-	if d, err = file.transform.ReadBlock(int64(file.blockPos), d); err != nil {
-		file.seekBlock(file.blockPos)
+	return file.transform.ReadBlock(n, d)
+}
+
+// isHole returns true if block n, stored as raw, is a hole: a HoleTracker transform decides, otherwise the block must
+// be a hole created since the file was opened, or be stored as zero bytes only.
+func (file *BlockFile) isHole(n int64, raw []byte) bool {
+	if h, ok := file.transform.(HoleTracker); ok {
+		return h.IsHole(n)
+	}
+	file.mu.Lock()
+	known := file.holes.has(n)
+	file.mu.Unlock()
+	return known || allZero(raw)
+}
+
+// blockPosition returns the position of block n in the underlying file.
+func (file *BlockFile) blockPosition(n int64) int64 {
+	pos, _ := file.interlay.GetReadSlice(n)
+	return pos
+}
+
+// readAt reads the raw block n into rb.
+func (file *BlockFile) readAt(rb []byte, n int64) error {
+	var m int
+	var err error
+	if ra, ok := file.data.(io.ReaderAt); ok {
+		m, err = ra.ReadAt(rb, file.blockPosition(n))
+	} else {
+		file.mu.Lock()
+		if _, err = file.data.Seek(file.blockPosition(n), io.SeekStart); err == nil {
+			m, err = io.ReadFull(file.data, rb)
+		}
+		file.mu.Unlock()
+	}
+	if m == len(rb) {
+		return nil
+	}
+	if err == nil || err == io.ErrUnexpectedEOF || (err == io.EOF && m > 0) {
+		return io.ErrShortBuffer
+	}
+	return err
+}
+
+// ReadBlocks reads count blocks from block start on with a single read of the underlying file, and returns their
+// data. The seek position is not used or changed. d is reallocated if nil or smaller than count*BlockSize(). If the
+// file ends before, the complete blocks are returned with io.EOF, or io.ErrShortBuffer if a partial block follows.
+func (file *BlockFile) ReadBlocks(start, count int64, d []byte) ([][]byte, error) {
+	if err := checkPanic(); err != nil {
 		return nil, err
 	}
-	file.blockPos++
-	return d, nil
+	if start < 0 || count < 0 {
+		return nil, os.ErrInvalid
+	}
+	_, rangeLen := file.interlay.GetReadRange(start, count)
+	if d == nil || cap(d) < int(rangeLen) {
+		d = make([]byte, rangeLen)
+	}
+	d = d[:rangeLen]
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	defer file.lockBlocks(start, count, false)()
+	complete, err := file.readRaw(start, count, d)
+	stride := int(file.interlay.Stride())
+	blocks := make([][]byte, 0, complete)
+	for i := 0; i < complete; i++ {
+		raw := d[i*stride : i*stride+file.blockSize]
+		if file.isHole(start+int64(i), raw) {
+			clear(raw[:file.dataSize])
+			blocks = append(blocks, raw[:file.dataSize])
+			continue
+		}
+		b, terr := file.transform.ReadBlock(start+int64(i), raw)
+		if terr != nil {
+			return nil, terr
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, err
+}
+
+// readBlocksInto reads len(dsts) blocks from block start on with a single read of the underlying file, and
+// transforms each block straight into dsts[i], which must have a length of BlockSize(). The data is returned like by
+// ReadBlocks. Only ciphertext passes through the intermediate buffer.
+func (file *BlockFile) readBlocksInto(start int64, dsts [][]byte) ([][]byte, error) {
+	if err := checkPanic(); err != nil {
+		return nil, err
+	}
+	count := int64(len(dsts))
+	_, rangeLen := file.interlay.GetReadRange(start, count)
+	buf := file.getBuf(int(rangeLen))
+	defer file.bufs.Put(buf)
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	defer file.lockBlocks(start, count, false)()
+	complete, err := file.readRaw(start, count, *buf)
+	stride := int(file.interlay.Stride())
+	t, inPlace := file.transform.(InPlaceReader)
+	blocks := make([][]byte, 0, complete)
+	for i := 0; i < complete; i++ {
+		raw, dst := (*buf)[i*stride:i*stride+file.blockSize], dsts[i][:file.blockSize]
+		if file.isHole(start+int64(i), raw) {
+			clear(dst)
+			blocks = append(blocks, dst[:file.dataSize])
+			continue
+		}
+		var b []byte
+		var terr error
+		if inPlace {
+			b, terr = t.ReadBlockTo(start+int64(i), dst[:file.dataSize], raw)
+		} else {
+			copy(dst, raw)
+			b, terr = file.transform.ReadBlock(start+int64(i), dst)
+		}
+		if terr != nil {
+			return nil, terr
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, err
+}
+
+// readRaw reads count raw blocks from block start on into d, which must hold the range of the blocks, and returns
+// the number of complete blocks. If the file ends before, io.EOF is returned, or io.ErrShortBuffer if a partial block
+// follows. The caller must hold the locks.
+func (file *BlockFile) readRaw(start, count int64, d []byte) (int, error) {
+	pos, rangeLen := file.interlay.GetReadRange(start, count)
+	size, stride := int(rangeLen), int(file.interlay.Stride())
+	m, err := file.readRange(d[:size], pos)
+	complete := 0
+	if m >= file.blockSize {
+		complete = (m-file.blockSize)/stride + 1
+	}
+	if m == size {
+		err = nil
+	} else if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = io.EOF
+		if m > complete*stride {
+			err = io.ErrShortBuffer
+		}
+	}
+	return complete, err
+}
+
+// readRange reads len(rb) bytes of the underlying file at pos. See readFullAt.
+func (file *BlockFile) readRange(rb []byte, pos int64) (int, error) {
+	if _, ok := file.data.(io.ReaderAt); ok {
+		return readFullAt(file.data, rb, pos)
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	return readFullAt(file.data, rb, pos)
+}
+
+// WriteBlocks writes the data of blocks as consecutive blocks from block start on, including their padding, with a
+// single write of the underlying file. The seek position is not used or changed.
+func (file *BlockFile) WriteBlocks(start int64, blocks [][]byte) error {
+	if err := checkPanic(); err != nil {
+		return err
+	}
+	if file.readOnly {
+		return ErrReadOnly
+	}
+	if start < 0 {
+		return os.ErrInvalid
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	pos, _ := file.interlay.GetReadSlice(start)
+	stride := int(file.interlay.Stride())
+	buf := file.getBuf(len(blocks) * stride)
+	defer file.bufs.Put(buf)
+	d := *buf
+	t, inPlace := file.transform.(InPlaceTransform)
+	for i, data := range blocks {
+		var b []byte
+		var err error
+		dst := d[i*stride : i*stride+file.blockSize]
+		clear(d[i*stride+file.blockSize : (i+1)*stride])
+		if inPlace {
+			b, err = t.WriteBlockTo(start+int64(i), dst, data)
+		} else {
+			b, err = file.transform.WriteBlock(start+int64(i), data)
+		}
+		if err != nil {
+			return err
+		}
+		if len(b) != file.blockSize {
+			return io.ErrShortWrite
+		}
+		copy(dst, b)
+	}
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	defer file.lockBlocks(start, int64(len(blocks)), true)()
+	if _, ok := file.data.(io.WriterAt); ok {
+		_, err := writeFullAt(file.data, d, pos)
+		if err != nil {
+			return err
+		}
+	} else {
+		file.mu.Lock()
+		_, err := writeFullAt(file.data, d, pos)
+		file.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return file.grow(start, start+int64(len(blocks)))
 }
 
 // WriteBlock writes a block and updates the seek position to the next block.
 func (file *BlockFile) WriteBlock(d []byte) error {
+	file.mu.Lock()
+	block := file.blockPos
+	file.mu.Unlock()
+	if err := file.WriteBlockAt(block, d); err != nil {
+		return err
+	}
+	file.mu.Lock()
+	file.blockPos = block + 1
+	file.mu.Unlock()
+	return nil
+}
+
+// WriteBlockAt writes block n without using or changing the seek position. Writes of different blocks happen in
+// parallel if the underlying file implements io.WriterAt.
+func (file *BlockFile) WriteBlockAt(n int64, d []byte) error {
+	if err := checkPanic(); err != nil {
+		return err
+	}
+	if file.readOnly {
+		return ErrReadOnly
+	}
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	l := file.blockLock(n)
+	l.Lock()
+	defer l.Unlock()
+	return file.writeBlockAt(n, d)
+}
+
+// writeBlockAt writes block n. The caller must hold the locks.
+func (file *BlockFile) writeBlockAt(n int64, d []byte) error {
 	var err error
-	if file.numBlocks == 0 {
-		if _, err := file.getNumBlocks(); err != nil {
+	if t, ok := file.transform.(InPlaceTransform); ok {
+		buf := file.getBuf(file.blockSize)
+		defer file.bufs.Put(buf)
+		if d, err = t.WriteBlockTo(n, *buf, d); err != nil {
 			return err
 		}
-	} else if err := file.seekBlock(file.blockPos); err != nil {
+	} else if d, err = file.transform.WriteBlock(n, d); err != nil {
 		return err
 	}
-	d, err = file.transform.WriteBlock(int64(file.blockPos), d)
-	if err != nil {
-		return err
+	return file.writeAt(d, n)
+}
+
+// getBuf returns a buffer of size bytes from the pool. It must be returned with file.bufs.Put.
+func (file *BlockFile) getBuf(size int) *[]byte {
+	if buf, ok := file.bufs.Get().(*[]byte); ok && cap(*buf) >= size {
+		*buf = (*buf)[:size]
+		return buf
 	}
-	if n, err := file.data.Write(d); err != nil {
-		file.seekBlock(file.blockPos)
+	buf := make([]byte, size)
+	return &buf
+}
+
+// writeAt writes the raw block n and updates the number of blocks. If the layout has padding, it is written as well,
+// so that aligned blocks are written as a whole.
+func (file *BlockFile) writeAt(d []byte, n int64) error {
+	var m int
+	var err error
+	if stride := int(file.interlay.Stride()); stride > file.blockSize {
+		buf := file.getBuf(stride)
+		defer file.bufs.Put(buf)
+		copy(*buf, d[:file.blockSize])
+		clear((*buf)[file.blockSize:])
+		d = *buf
+	}
+	if wa, ok := file.data.(io.WriterAt); ok {
+		m, err = wa.WriteAt(d, file.blockPosition(n))
+	} else {
+		file.mu.Lock()
+		if _, err = file.data.Seek(file.blockPosition(n), io.SeekStart); err == nil {
+			m, err = file.data.Write(d)
+		}
+		file.mu.Unlock()
+	}
+	if err != nil {
 		return err
-	} else if n < file.blockSize {
-		file.seekBlock(file.blockPos)
+	} else if m < file.blockSize {
 		return io.ErrShortWrite
 	}
-	if file.blockPos == file.numBlocks {
-		file.numBlocks++
+	return file.grow(n, n+1)
+}
+
+// grow updates the number of blocks and the holes after the blocks from start up to end have been written.
+func (file *BlockFile) grow(start, end int64) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	file.modified = true
+	file.holes.remove(start, end)
+	if file.numBlocks == 0 {
+		_, err := file.getNumBlocks()
+		return err
+	} else if end > file.numBlocks {
+		file.holes.add(file.numBlocks, start)
+		file.numBlocks = end
 	}
-	file.blockPos++
 	return nil
 }
 
+// Truncate changes the number of blocks of the file to n. Discarded blocks are overwritten with random data and
+// flushed to stable storage before the underlying file is truncated. Added blocks are holes. The header is
+// synced afterwards. A Journal or an object store is instead synced once after the header, which commits header,
+// blocks and size together and wipes or removes the discarded blocks. The seek position is moved to n if it is
+// beyond. The underlying file must support Truncate, otherwise errors.ErrUnsupported is returned.
+func (file *BlockFile) Truncate(n int64) error {
+	return file.TruncateContext(context.Background(), n)
+}
+
+// TruncateContext is like Truncate, but wiping is aborted when ctx is done. Blocks are wiped from the end, and the
+// file is then truncated after the last block that has not been wiped yet, so that it stays consistent.
+func (file *BlockFile) TruncateContext(ctx context.Context, n int64) error {
+	if err := checkPanic(); err != nil {
+		return err
+	}
+	if file.readOnly {
+		return ErrReadOnly
+	}
+	if n < 0 {
+		return os.ErrInvalid
+	}
+	t, ok := file.data.(truncater)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	file.rw.Lock()
+	defer file.rw.Unlock()
+	numBlocks, err := file.countBlocks()
+	if err != nil {
+		return err
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	_, commits := file.data.(committer)
+	var wipeErr error
+	if n < numBlocks && !commits {
+		var wiped int64
+		if wiped, wipeErr = file.wipeBlocks(ctx, n, numBlocks); wipeErr != nil {
+			if wiped == numBlocks {
+				return wipeErr
+			}
+			n = wiped
+		}
+	}
+	if n != numBlocks {
+		if err := t.Truncate(file.interlay.EndPosition(n)); err != nil {
+			return err
+		}
+		file.holes.truncate(n)
+		file.holes.add(numBlocks, n)
+		file.numBlocks = n
+		file.modified = true
+	}
+	if file.blockPos > n {
+		file.blockPos = n
+	}
+	if tt, ok := file.transform.(Truncater); ok {
+		if err := tt.Truncate(n); err != nil {
+			return err
+		}
+	}
+	if err := file.syncHeader(context.Background()); err != nil {
+		return err
+	}
+	if commits {
+		// Header, blocks and the new size are committed together, the backend removes the discarded data
+		return file.syncData(ctx)
+	}
+	return wipeErr
+}
+
+// wipeBlocks overwrites the blocks from start up to end with random data, beginning with the last one, and flushes
+// them to stable storage, if supported. If ctx is done, it stops before the next block. It returns the first wiped
+// block, or end if none was wiped or flushing failed.
+func (file *BlockFile) wipeBlocks(ctx context.Context, start, end int64) (int64, error) {
+	var err error
+	r := make([]byte, 32*1024)
+	n := end
+	for ; n > start; n-- {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if err = overwriteRange(file.data, file.blockPosition(n-1), file.interlay.EndPosition(n), r); err != nil {
+			// The block is partially wiped and has to go as well
+			n--
+			break
+		}
+	}
+	if s, ok := file.data.(syncer); ok && n < end {
+		if serr := s.Sync(); serr != nil {
+			return end, serr
+		}
+	}
+	return n, err
+}
+
 // getNumBlocks returns the number of blocks in the file.
 func (file *BlockFile) getNumBlocks() (int64, error) {
+	if s, ok := file.data.(sizer); ok {
+		file.numBlocks = file.interlay.Blocks(s.Len())
+		return file.numBlocks, nil
+	}
 	n, err := file.data.Seek(0, io.SeekEnd)
 	if err != nil {
 		file.seekBlock(file.blockPos)
 		return 0, err
 	}
-	n = n - int64(file.headerSize)
-	if n <= 0 {
-		n = 0
-	}
-	file.numBlocks = (n / int64(file.blockSize))
+	file.numBlocks = file.interlay.Blocks(n)
 	return file.numBlocks, file.seekBlock(file.blockPos)
 }
 
+// NumBlocks returns the number of blocks in the file.
 func (file *BlockFile) NumBlocks() (int64, error) {
+	if err := checkPanic(); err != nil {
+		return 0, err
+	}
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	return file.countBlocks()
+}
+
+// countBlocks returns the number of blocks in the file, determining it if unknown.
+func (file *BlockFile) countBlocks() (int64, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
 	if file.numBlocks == 0 {
 		if _, err := file.getNumBlocks(); err != nil {
 			return file.numBlocks, err
@@ -256,8 +944,15 @@ func (file *BlockFile) NumBlocks() (int64, error) {
 	return file.numBlocks, nil
 }
 
-// SeekBlock seeks to the given block.
+// SeekBlock seeks to the given block. Seeking past the end is allowed, writing there leaves holes.
 func (file *BlockFile) SeekBlock(offset int64, whence int) (int64, error) {
+	if err := checkPanic(); err != nil {
+		return 0, err
+	}
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	file.mu.Lock()
+	defer file.mu.Unlock()
 	switch whence {
 	case io.SeekStart:
 		file.blockPos = offset
@@ -273,8 +968,5 @@ func (file *BlockFile) SeekBlock(offset int64, whence int) (int64, error) {
 	if file.blockPos < 0 {
 		file.blockPos = 0
 	}
-	if file.blockPos > (file.numBlocks + 1) {
-		file.blockPos = file.numBlocks + 1
-	}
 	return file.blockPos, file.seekBlock(file.blockPos)
 }
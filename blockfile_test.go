@@ -1,9 +1,14 @@
 package fullfile
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -50,13 +55,22 @@ func (ttf *TestTransform) FullRead(r io.Reader) ([]byte, error) {
 	return ttf.SyncHeader()
 }
 
+// inPlaceTransform is a TestTransform that writes blocks into the buffers of the BlockFile.
+type inPlaceTransform struct {
+	TestTransform
+}
+
+func (ttf *inPlaceTransform) WriteBlockTo(n int64, dst, data []byte) ([]byte, error) {
+	copy(dst[0:32], "pre---------PREFIX-----------PRE")
+	m := copy(dst[32:64], data)
+	clear(dst[32+m : 64])
+	copy(dst[64:96], "post--------POSTFIX---------POST")
+	return dst[:96], nil
+}
+
 func TestFullFile(t *testing.T) {
 	transform := new(TestTransform)
-	file, err := ioutil.TempFile("", "testfullfile.")
-	if err != nil {
-		t.Fatalf("TempFile: %s", err)
-	}
-	defer os.Remove(file.Name())
+	file := NewMemFile()
 	defer file.Close()
 	bfile, err := NewBlockFile(file, transform)
 	if err != nil {
@@ -70,3 +84,521 @@ func TestFullFile(t *testing.T) {
 	bfile.WriteBlock([]byte("Test Block 003"))
 	defer bfile.Close()
 }
+
+func TestBlockFileAt(t *testing.T) {
+	transform := new(TestTransform)
+	file := NewMemFile()
+	defer file.Close()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	block := func(i int64) []byte {
+		return bytes.Repeat([]byte{byte(i)}, transform.DataSize())
+	}
+	var wg sync.WaitGroup
+	for i := int64(0); i < 16; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			if err := bfile.WriteBlockAt(i, block(i)); err != nil {
+				t.Errorf("WriteBlockAt %d: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 16 {
+		t.Errorf("NumBlocks: %d!=%d", n, 16)
+	}
+	for i := int64(0); i < 16; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			if d, err := bfile.ReadBlockAt(i, nil); err != nil {
+				t.Errorf("ReadBlockAt %d: %s", i, err)
+			} else if !bytes.Equal(d, block(i)) {
+				t.Errorf("False data %d:\n\t%x\n\t%x", i, block(i), d)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err := bfile.ReadBlockAt(16, nil); err != io.EOF {
+		t.Errorf("ReadBlockAt past end: %v", err)
+	}
+}
+
+func TestBlockFileBlocks(t *testing.T) {
+	transform := new(TestTransform)
+	file := NewMemFile()
+	defer file.Close()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	blocks := make([][]byte, 70)
+	for i := range blocks {
+		blocks[i] = bytes.Repeat([]byte{byte(i)}, transform.DataSize())
+	}
+	if err := bfile.WriteBlocks(0, blocks[:5]); err != nil {
+		t.Fatalf("WriteBlocks: %s", err)
+	}
+	if err := bfile.WriteBlocks(5, blocks[5:]); err != nil {
+		t.Fatalf("WriteBlocks: %s", err)
+	}
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 70 {
+		t.Errorf("NumBlocks: %d!=%d", n, 70)
+	}
+	d, err := bfile.ReadBlocks(3, 65, nil)
+	if err != nil {
+		t.Fatalf("ReadBlocks: %s", err)
+	} else if len(d) != 65 {
+		t.Fatalf("ReadBlocks: %d!=%d blocks", len(d), 65)
+	}
+	for i := range d {
+		if !bytes.Equal(d[i], blocks[3+i]) {
+			t.Errorf("False data %d:\n\t%x\n\t%x", 3+i, blocks[3+i], d[i])
+		}
+	}
+	if d, err := bfile.ReadBlocks(68, 4, nil); err != io.EOF {
+		t.Errorf("ReadBlocks past end: %v", err)
+	} else if len(d) != 2 {
+		t.Errorf("ReadBlocks past end: %d!=%d blocks", len(d), 2)
+	}
+	if d, err := bfile.ReadBlockAt(69, nil); err != nil {
+		t.Fatalf("ReadBlockAt: %s", err)
+	} else if !bytes.Equal(d, blocks[69]) {
+		t.Errorf("False data 69:\n\t%x\n\t%x", blocks[69], d)
+	}
+}
+
+func TestBlockFileAllocs(t *testing.T) {
+	transform := new(inPlaceTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	defer bfile.Close()
+	d := make([]byte, transform.DataSize())
+	buf := make([]byte, transform.BlockSize())
+	var i int64
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := bfile.WriteBlockAt(i%16, d); err != nil {
+			t.Fatalf("WriteBlockAt: %s", err)
+		}
+		i++
+	})
+	if allocs != 0 {
+		t.Errorf("Allocations per block write: %.1f", allocs)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		if _, err := bfile.ReadBlockAt(i%16, buf); err != nil {
+			t.Fatalf("ReadBlockAt: %s", err)
+		}
+		i++
+	})
+	if allocs != 0 {
+		t.Errorf("Allocations per block read: %.1f", allocs)
+	}
+}
+
+func BenchmarkBlockFileWriteBlockAt(b *testing.B) {
+	bfile := benchmarkBlockFile(b)
+	defer bfile.Close()
+	d := make([]byte, bfile.DataSize())
+	b.SetBytes(int64(len(d)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bfile.WriteBlockAt(int64(i%1024), d); err != nil {
+			b.Fatalf("WriteBlockAt: %s", err)
+		}
+	}
+}
+
+func BenchmarkBlockFileReadBlockAt(b *testing.B) {
+	bfile := benchmarkBlockFile(b)
+	defer bfile.Close()
+	d := make([]byte, bfile.DataSize())
+	for i := int64(0); i < 1024; i++ {
+		if err := bfile.WriteBlockAt(i, d); err != nil {
+			b.Fatalf("WriteBlockAt: %s", err)
+		}
+	}
+	buf := make([]byte, bfile.BlockSize())
+	b.SetBytes(int64(len(d)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bfile.ReadBlockAt(int64(i%1024), buf); err != nil {
+			b.Fatalf("ReadBlockAt: %s", err)
+		}
+	}
+}
+
+func benchmarkBlockFile(b *testing.B) *BlockFile {
+	file, err := ioutil.TempFile(b.TempDir(), "benchmark.")
+	if err != nil {
+		b.Fatalf("TempFile: %s", err)
+	}
+	bfile, err := NewBlockFile(file, new(inPlaceTransform))
+	if err != nil {
+		b.Fatalf("NewBlockFile: %s", err)
+	}
+	return bfile
+}
+
+func TestBlockFileSparse(t *testing.T) {
+	transform := new(TestTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	defer bfile.Close()
+	d := bytes.Repeat([]byte{0xaa}, transform.DataSize())
+	if err := bfile.WriteBlockAt(3, d); err != nil {
+		t.Fatalf("WriteBlockAt: %s", err)
+	}
+	if pos, err := bfile.SeekBlock(8, io.SeekStart); err != nil {
+		t.Fatalf("SeekBlock: %s", err)
+	} else if pos != 8 {
+		t.Errorf("SeekBlock past end: %d!=%d", pos, 8)
+	}
+	if err := bfile.WriteBlock(d); err != nil {
+		t.Fatalf("WriteBlock: %s", err)
+	}
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 9 {
+		t.Errorf("NumBlocks: %d!=%d", n, 9)
+	}
+	zero := make([]byte, transform.DataSize())
+	blocks, err := bfile.ReadBlocks(0, 9, nil)
+	if err != nil {
+		t.Fatalf("ReadBlocks: %s", err)
+	}
+	for i, b := range blocks {
+		expect := zero
+		if i == 3 || i == 8 {
+			expect = d
+		}
+		if !bytes.Equal(b, expect) {
+			t.Errorf("False data %d:\n\t%x\n\t%x", i, expect, b)
+		}
+	}
+	if b, err := bfile.ReadBlockAt(5, nil); err != nil {
+		t.Fatalf("ReadBlockAt hole: %s", err)
+	} else if !bytes.Equal(b, zero) {
+		t.Errorf("False hole data:\n\t%x\n\t%x", zero, b)
+	}
+}
+
+// sparseTransform keeps a bitmap of the written blocks in the header and rejects blocks without prefix, like an
+// authenticating transform.
+type sparseTransform struct {
+	TestTransform
+	mu      sync.Mutex
+	written [48]byte
+}
+
+func (ttf *sparseTransform) Init(d []byte) error {
+	copy(ttf.written[:], d)
+	return nil
+}
+
+func (ttf *sparseTransform) SyncHeader() ([]byte, error) {
+	ttf.mu.Lock()
+	defer ttf.mu.Unlock()
+	return bytes.Clone(ttf.written[:]), nil
+}
+
+func (ttf *sparseTransform) ReadBlock(n int64, block []byte) ([]byte, error) {
+	if !bytes.HasPrefix(block, []byte("pre---")) {
+		return nil, errors.New("block not authenticated")
+	}
+	return ttf.TestTransform.ReadBlock(n, block)
+}
+
+func (ttf *sparseTransform) WriteBlock(n int64, data []byte) ([]byte, error) {
+	ttf.mu.Lock()
+	ttf.written[n/8] |= 1 << (n % 8)
+	ttf.mu.Unlock()
+	return ttf.TestTransform.WriteBlock(n, data)
+}
+
+func (ttf *sparseTransform) Truncate(n int64) error {
+	ttf.mu.Lock()
+	defer ttf.mu.Unlock()
+	for i := n; i < int64(len(ttf.written))*8; i++ {
+		ttf.written[i/8] &^= 1 << (i % 8)
+	}
+	return nil
+}
+
+func (ttf *sparseTransform) IsHole(n int64) bool {
+	ttf.mu.Lock()
+	defer ttf.mu.Unlock()
+	return ttf.written[n/8]&(1<<(n%8)) == 0
+}
+
+func TestBlockFileHoles(t *testing.T) {
+	transform := new(sparseTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	d := bytes.Repeat([]byte{0xaa}, transform.DataSize())
+	for _, n := range []int64{3, 8} {
+		if err := bfile.WriteBlockAt(n, d); err != nil {
+			t.Fatalf("WriteBlockAt: %s", err)
+		}
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	// Holes are known from the header after reopening
+	transform = new(sparseTransform)
+	bfile, err = NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	zero := make([]byte, transform.DataSize())
+	blocks, err := bfile.ReadBlocks(0, 9, nil)
+	if err != nil {
+		t.Fatalf("ReadBlocks: %s", err)
+	}
+	for i, b := range blocks {
+		expect := zero
+		if i == 3 || i == 8 {
+			expect = d
+		}
+		if !bytes.Equal(b, expect) {
+			t.Errorf("False data %d:\n\t%x\n\t%x", i, expect, b)
+		}
+	}
+	// A zeroed block that has been written is not a hole
+	pos, _ := bfile.interlay.GetReadSlice(3)
+	if _, err := files[0].WriteAt(make([]byte, transform.BlockSize()), pos); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if _, err := bfile.ReadBlockAt(3, nil); err == nil {
+		t.Error("Zeroed block read as hole")
+	}
+	if _, err := bfile.ReadBlocks(0, 9, nil); err == nil {
+		t.Error("Zeroed block read as hole by ReadBlocks")
+	}
+}
+
+// TestBlockFileHolesUntracked leaves holes with a transform that does not track them.
+func TestBlockFileHolesUntracked(t *testing.T) {
+	transform := new(TestTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	d := bytes.Repeat([]byte{0xaa}, transform.DataSize())
+	for _, n := range []int64{3, 8, 12} {
+		if err := bfile.WriteBlockAt(n, d); err != nil {
+			t.Fatalf("WriteBlockAt: %s", err)
+		}
+	}
+	if err := bfile.Truncate(16); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if err := bfile.WriteBlockAt(10, d); err != nil {
+		t.Fatalf("WriteBlockAt: %s", err)
+	}
+	expect := holeExtents{{4, 8}, {9, 10}, {11, 12}, {13, 16}}
+	if fmt.Sprint(bfile.holes) != fmt.Sprint(expect) {
+		t.Errorf("False holes: %v!=%v", bfile.holes, expect)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	zero := make([]byte, transform.DataSize())
+	for _, reopen := range []bool{false, true} {
+		if reopen {
+			// Holes are stored as zero bytes
+			if bfile, err = NewBlockFile(files[0], transform); err != nil {
+				t.Fatalf("NewBlockFile: %s", err)
+			}
+		}
+		blocks, err := bfile.ReadBlocks(0, 16, nil)
+		if err != nil {
+			t.Fatalf("ReadBlocks: %s", err)
+		}
+		for i, b := range blocks {
+			expect := zero
+			if i == 3 || i == 8 || i == 10 || i == 12 {
+				expect = d
+			}
+			if !bytes.Equal(b, expect) {
+				t.Errorf("False data %d:\n\t%x\n\t%x", i, expect, b)
+			}
+		}
+	}
+}
+
+func TestHoleExtents(t *testing.T) {
+	var h holeExtents
+	h.add(10, 20)
+	h.add(30, 40)
+	h.add(20, 25)
+	h.add(5, 8)
+	h.remove(12, 14)
+	h.add(26, 30)
+	h.remove(35, 50)
+	expect := holeExtents{{5, 8}, {10, 12}, {14, 25}, {26, 35}}
+	if fmt.Sprint(h) != fmt.Sprint(expect) {
+		t.Errorf("False extents: %v!=%v", h, expect)
+	}
+	for n, hole := range map[int64]bool{4: false, 5: true, 8: false, 11: true, 12: false, 24: true, 25: false, 34: true} {
+		if h.has(n) != hole {
+			t.Errorf("has(%d): %t!=%t", n, h.has(n), hole)
+		}
+	}
+	h.truncate(11)
+	if expect := (holeExtents{{5, 8}, {10, 11}}); fmt.Sprint(h) != fmt.Sprint(expect) {
+		t.Errorf("False extents after truncate: %v!=%v", h, expect)
+	}
+}
+
+type fullReadTransform struct {
+	TestTransform
+	contextCalls int
+}
+
+func (ttf *fullReadTransform) Init(d []byte) error {
+	return ErrFullReadRequired
+}
+
+func (ttf *fullReadTransform) SyncHeader() ([]byte, error) {
+	return nil, ErrFullReadRequired
+}
+
+func (ttf *fullReadTransform) FullRead(r io.Reader) ([]byte, error) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, err
+	}
+	return []byte("h-------------FULLREAD-------------------------H"), nil
+}
+
+type contextTransform struct {
+	fullReadTransform
+}
+
+func (ttf *contextTransform) FullReadContext(ctx context.Context, r io.Reader) ([]byte, error) {
+	ttf.contextCalls++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ttf.FullRead(r)
+}
+
+func TestBlockFileContext(t *testing.T) {
+	files := memFiles(t, 1)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	transform := new(fullReadTransform)
+	if _, err := NewBlockFileContext(cancelled, files[0], transform); err != context.Canceled {
+		t.Errorf("NewBlockFileContext cancelled: %v", err)
+	}
+	bfile, err := NewBlockFileContext(context.Background(), files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFileContext: %s", err)
+	}
+	if err := bfile.WriteBlockAt(0, []byte("data")); err != nil {
+		t.Fatalf("WriteBlockAt: %s", err)
+	}
+	if err := bfile.SyncContext(cancelled); err != context.Canceled {
+		t.Errorf("SyncContext cancelled: %v", err)
+	}
+	header := make([]byte, transform.HeaderSize())
+	if _, err := files[0].ReadAt(header, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if !bytes.Equal(header, make([]byte, len(header))) {
+		t.Errorf("Header written by cancelled sync: %q", header)
+	}
+	if err := bfile.SyncContext(context.Background()); err != nil {
+		t.Fatalf("SyncContext: %s", err)
+	}
+	if _, err := files[0].ReadAt(header, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if !bytes.Contains(header, []byte("FULLREAD")) {
+		t.Errorf("Header not synced: %q", header)
+	}
+	// Transforms implementing ContextFullReader get the context
+	ctransform := new(contextTransform)
+	if _, err := NewBlockFileContext(cancelled, files[0], ctransform); err != context.Canceled {
+		t.Errorf("NewBlockFileContext cancelled: %v", err)
+	}
+	if _, err := NewBlockFileContext(context.Background(), files[0], ctransform); err != nil {
+		t.Fatalf("NewBlockFileContext: %s", err)
+	} else if ctransform.contextCalls != 1 {
+		t.Errorf("FullReadContext calls: %d!=%d", ctransform.contextCalls, 1)
+	}
+}
+
+// countdownContext is done once its Err method has been called n times.
+type countdownContext struct {
+	context.Context
+	n atomic.Int64
+}
+
+func newCountdownContext(n int64) *countdownContext {
+	ctx := &countdownContext{Context: context.Background()}
+	ctx.n.Store(n)
+	return ctx
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestBlockFileTruncateContext(t *testing.T) {
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], new(TestTransform))
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := bfile.WriteBlock([]byte{byte(i)}); err != nil {
+			t.Fatalf("WriteBlock: %s", err)
+		}
+	}
+	// Three blocks are wiped before the cancellation
+	if err := bfile.TruncateContext(newCountdownContext(3), 2); err != context.Canceled {
+		t.Errorf("TruncateContext cancelled: %v", err)
+	}
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 7 {
+		t.Errorf("NumBlocks: %d!=%d", n, 7)
+	}
+	if size, _ := files[0].Seek(0, io.SeekEnd); size != 48+7*96 {
+		t.Errorf("Size: %d!=%d", size, 48+7*96)
+	}
+	for i := int64(0); i < 7; i++ {
+		if d, err := bfile.ReadBlockAt(i, nil); err != nil {
+			t.Fatalf("ReadBlockAt %d: %s", i, err)
+		} else if d[0] != byte(i) {
+			t.Errorf("False data %d: %x", i, d)
+		}
+	}
+	if err := bfile.TruncateContext(context.Background(), 2); err != nil {
+		t.Fatalf("TruncateContext: %s", err)
+	}
+	if n, _ := bfile.NumBlocks(); n != 2 {
+		t.Errorf("NumBlocks: %d!=%d", n, 2)
+	}
+}
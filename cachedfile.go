@@ -0,0 +1,307 @@
+package fullfile
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// objectCacheSize is the number of unchanged objects a cachedFile keeps in memory.
+const objectCacheSize = 16
+
+// cachedFile is the part of ObjectFile and CASFile that keeps a file in memory as a header of headerSize bytes
+// followed by objects of objectSize bytes, and implements ReadWriteCloseSeeker on top of it. The backend loads and
+// stores the objects. cachedFile is safe for concurrent use.
+type cachedFile struct {
+	backend    cachedBackend
+	headerSize int64
+	objectSize int64
+	mu         sync.Mutex
+	dirty      bool // size or header changed since the last commit.
+	size       int64
+	header     []byte
+	objects    map[int64]*objectData
+	pos        int64
+	closed     bool
+}
+
+// cachedBackend stores the objects of a cachedFile. Its methods are called with the lock of the file held.
+type cachedBackend interface {
+	// load returns the content of object n, or nil if it is a hole.
+	load(n int64) ([]byte, error)
+	// resize changes the number of objects to num. Added objects are holes.
+	resize(num int64)
+	// save stores the changed objects, which are cut to the size of the file, together with size and header.
+	save(size int64, header []byte, changed map[int64][]byte) error
+	// close releases the resources of the backend.
+	close()
+}
+
+// objectData is an object in memory, always objectSize bytes long.
+type objectData struct {
+	d     []byte
+	dirty bool
+}
+
+// objectCount returns the number of objects of objectSize bytes of a file of size bytes with a header of headerSize
+// bytes.
+func objectCount(size, headerSize, objectSize int64) int64 {
+	if size <= headerSize {
+		return 0
+	}
+	return (size - headerSize + objectSize - 1) / objectSize
+}
+
+// newCachedFile returns an empty cachedFile.
+func newCachedFile(backend cachedBackend, headerSize, objectSize int64) cachedFile {
+	return cachedFile{
+		backend:    backend,
+		headerSize: headerSize,
+		objectSize: objectSize,
+		header:     make([]byte, headerSize),
+		objects:    make(map[int64]*objectData),
+	}
+}
+
+// numObjects returns the number of objects of a file of size bytes.
+func (f *cachedFile) numObjects(size int64) int64 {
+	return objectCount(size, f.headerSize, f.objectSize)
+}
+
+// object returns object n, loading it if necessary. f.mu must be held.
+func (f *cachedFile) object(n int64) (*objectData, error) {
+	if o, ok := f.objects[n]; ok {
+		return o, nil
+	}
+	o := &objectData{d: make([]byte, f.objectSize)}
+	d, err := f.backend.load(n)
+	if err != nil {
+		return nil, err
+	}
+	copy(o.d, d)
+	f.evict()
+	f.objects[n] = o
+	return o, nil
+}
+
+// evict removes unchanged objects from memory if there are too many. f.mu must be held.
+func (f *cachedFile) evict() {
+	if len(f.objects) < objectCacheSize {
+		return
+	}
+	for n, o := range f.objects {
+		if !o.dirty {
+			delete(f.objects, n)
+		}
+	}
+}
+
+// access copies between p and the file at off, which must lie inside the file. f.mu must be held.
+func (f *cachedFile) access(p []byte, off int64, write bool) error {
+	for len(p) > 0 {
+		var d []byte
+		if off < f.headerSize {
+			d = f.header[off:]
+			f.dirty = f.dirty || write
+		} else {
+			n, pos, _ := chunkSpan(off-f.headerSize, int64(len(p)), f.objectSize)
+			o, err := f.object(n)
+			if err != nil {
+				return err
+			}
+			o.dirty = o.dirty || write
+			d = o.d[pos:]
+		}
+		var m int
+		if write {
+			m = copy(d, p)
+		} else {
+			m = copy(p, d)
+		}
+		p = p[m:]
+		off += int64(m)
+	}
+	return nil
+}
+
+// truncate changes the size of the file. f.mu must be held.
+func (f *cachedFile) truncate(size int64) error {
+	num := f.numObjects(size)
+	f.backend.resize(num)
+	if size < f.size {
+		if size < f.headerSize {
+			clear(f.header[size:])
+		}
+		for n := range f.objects {
+			if n >= num {
+				delete(f.objects, n)
+			}
+		}
+		if end := size - f.headerSize; num > 0 && end%f.objectSize != 0 {
+			o, err := f.object(num - 1)
+			if err != nil {
+				return err
+			}
+			clear(o.d[end%f.objectSize:])
+			o.dirty = true
+		}
+	}
+	f.size = size
+	f.dirty = true
+	return nil
+}
+
+// commit passes the changes to the backend. f.mu must be held.
+func (f *cachedFile) commit() error {
+	changed := make(map[int64][]byte)
+	for n, o := range f.objects {
+		if o.dirty {
+			changed[n] = o.d[:min64(f.objectSize, f.size-f.headerSize-n*f.objectSize)]
+		}
+	}
+	if !f.dirty && len(changed) == 0 {
+		return nil
+	}
+	if err := f.backend.save(f.size, f.header, changed); err != nil {
+		return err
+	}
+	f.dirty = false
+	for _, o := range f.objects {
+		o.dirty = false
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes at offset off. It implements io.ReaderAt.
+func (f *cachedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+// readAt reads len(p) bytes at offset off. f.mu must be held.
+func (f *cachedFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := int(min64(int64(len(p)), f.size-off))
+	if err := f.access(p[:n], off, false); err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off. It implements io.WriterAt. Writing past the end leaves holes.
+func (f *cachedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at offset off. f.mu must be held.
+func (f *cachedFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if end := off + int64(len(p)); end > f.size {
+		if err := f.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.access(p, off, true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read reads from the current position.
+func (f *cachedFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current position.
+func (f *cachedFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the current position.
+func (f *cachedFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+// Truncate changes the size of the file.
+func (f *cachedFile) Truncate(size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.truncate(size)
+}
+
+// Sync commits the changes.
+func (f *cachedFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.commit()
+}
+
+// Close commits the changes and releases the memory of the file, even if the commit fails.
+func (f *cachedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	err := f.commit()
+	f.backend.close()
+	f.closed, f.objects, f.header = true, nil, nil
+	return err
+}
+
+// commitsOnSync marks cachedFile as committer.
+func (f *cachedFile) commitsOnSync() {}
@@ -0,0 +1,322 @@
+package fullfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// casHashSize is the size of the keyed hashes that address blocks in a CASStore.
+const casHashSize = sha256.Size
+
+var (
+	// ErrHashMismatch is returned when a block of a CASStore does not match its hash, because it is damaged or the
+	// key is wrong.
+	ErrHashMismatch = errors.New("content-addressed block does not match its hash")
+)
+
+// CASStore is a content-addressed store of blocks in a directory. Blocks are stored once under their keyed hash in
+// dir/objects, files are manifests of block hashes in dir/manifests. Identical blocks of files that use the same
+// key, for example different versions of a vault, are thus stored only once. GC removes blocks no longer referenced.
+// CASStore is safe for concurrent use, but GC must not run while other processes write to the store.
+type CASStore struct {
+	dir string
+	mu  sync.RWMutex // held shared by commits and exclusively by GC.
+}
+
+// OpenCASStore opens the store in dir, creating it if it does not exist.
+func OpenCASStore(dir string) (*CASStore, error) {
+	s := &CASStore{dir: dir}
+	for _, d := range []string{s.objectDir(), s.manifestDir()} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *CASStore) objectDir() string   { return filepath.Join(s.dir, "objects") }
+func (s *CASStore) manifestDir() string { return filepath.Join(s.dir, "manifests") }
+
+// objectPath returns the path of the block with hash h.
+func (s *CASStore) objectPath(h []byte) string {
+	name := hex.EncodeToString(h)
+	return filepath.Join(s.objectDir(), name[:2], name)
+}
+
+// manifestPath returns the path of the manifest of the file name.
+func (s *CASStore) manifestPath(name string) string {
+	return filepath.Join(s.manifestDir(), name)
+}
+
+// writeFile writes d to path atomically, through a temporary file in the same directory, and syncs the directory.
+func writeFile(path string, d []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+atomicTempInfix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// put stores block d with hash h, unless it is already stored.
+func (s *CASStore) put(h, d []byte) error {
+	path := s.objectPath(h)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := syncDir(s.objectDir()); err != nil {
+			return err
+		}
+	}
+	return writeFile(path, d)
+}
+
+// get returns the block with hash h.
+func (s *CASStore) get(h []byte) ([]byte, error) {
+	return os.ReadFile(s.objectPath(h))
+}
+
+// Remove removes the manifest of the file name. Its blocks are removed by the next GC, unless other files use them.
+func (s *CASStore) Remove(name string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return os.Remove(s.manifestPath(name))
+}
+
+// GC wipes and removes all blocks that are not referenced by any manifest, and returns their number.
+func (s *CASStore) GC() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := make(map[string]struct{})
+	manifests, err := os.ReadDir(s.manifestDir())
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range manifests {
+		if !e.Type().IsRegular() || strings.Contains(e.Name(), atomicTempInfix) {
+			continue
+		}
+		d, err := os.ReadFile(filepath.Join(s.manifestDir(), e.Name()))
+		if err != nil {
+			return 0, err
+		}
+		m, err := decodeManifest(d)
+		if err != nil {
+			return 0, err
+		}
+		for _, h := range m.hashes {
+			used[hex.EncodeToString(h)] = struct{}{}
+		}
+	}
+	removed := 0
+	err = filepath.WalkDir(s.objectDir(), func(path string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() {
+			return err
+		}
+		if _, ok := used[e.Name()]; ok {
+			return nil
+		}
+		if err := wipeFile(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// casManifest is the content of a manifest: the size of the file, the header and the hashes of the blocks. Holes
+// have an all-zero hash.
+type casManifest struct {
+	size      int64
+	blockSize int64
+	header    []byte
+	hashes    [][]byte
+}
+
+// encode returns the manifest as bytes: size, header size and block size, followed by header and hashes.
+func (m *casManifest) encode() []byte {
+	d := make([]byte, 24, 24+len(m.header)+casHashSize*len(m.hashes))
+	binary.BigEndian.PutUint64(d[0:8], uint64(m.size))
+	binary.BigEndian.PutUint64(d[8:16], uint64(len(m.header)))
+	binary.BigEndian.PutUint64(d[16:24], uint64(m.blockSize))
+	d = append(d, m.header...)
+	for _, h := range m.hashes {
+		d = append(d, h...)
+	}
+	return d
+}
+
+// decodeManifest parses a manifest.
+func decodeManifest(d []byte) (*casManifest, error) {
+	if len(d) < 24 {
+		return nil, ErrInvalidObject
+	}
+	m := &casManifest{
+		size:      int64(binary.BigEndian.Uint64(d[0:8])),
+		blockSize: int64(binary.BigEndian.Uint64(d[16:24])),
+	}
+	headerSize := int64(binary.BigEndian.Uint64(d[8:16]))
+	if m.size < 0 || headerSize < 0 || m.blockSize <= 0 || headerSize > int64(len(d)-24) {
+		return nil, ErrInvalidObject
+	}
+	m.header = d[24 : 24+headerSize]
+	d = d[24+headerSize:]
+	if len(d)%casHashSize != 0 || int64(len(d)/casHashSize) != objectCount(m.size, headerSize, m.blockSize) {
+		return nil, ErrInvalidObject
+	}
+	for ; len(d) > 0; d = d[casHashSize:] {
+		m.hashes = append(m.hashes, d[:casHashSize])
+	}
+	return m, nil
+}
+
+// isZero returns true if b consists of zero bytes only.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CASFile is a file stored in a CASStore. The header, the first headerSize bytes of the file, is stored in the
+// manifest. The rest of the file is split into blocks of blockSize bytes, which are stored under their HMAC-SHA256
+// with key, so that files with unrelated keys never share blocks and the store does not reveal which of their blocks
+// are equal. Blocks consisting of zero bytes are holes that are not stored. To store each block of a BlockFile
+// separately, headerSize should be the header size and blockSize the block size of the layout (its stride).
+//
+// Changes are kept in memory until Sync or Close stores the changed blocks and replaces the manifest atomically. The
+// key is kept in a SecureBuffer, which is zeroed by Close and Panic.
+// CASFile is safe for concurrent use, but a file must only be opened once at a time.
+type CASFile struct {
+	cachedFile
+	store  *CASStore
+	name   string
+	key    *SecureBuffer
+	hashes [][]byte // the hash of each block, all zero for holes.
+}
+
+// OpenCASFile opens the file name of store, or an empty file if it does not exist. key is the key of the hashes.
+func (s *CASStore) OpenCASFile(name string, key []byte, headerSize, blockSize int64) (*CASFile, error) {
+	if headerSize < 0 || blockSize <= 0 || len(key) == 0 || name != filepath.Base(name) {
+		return nil, os.ErrInvalid
+	}
+	d, err := os.ReadFile(s.manifestPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var m *casManifest
+	if err == nil {
+		if m, err = decodeManifest(d); err != nil {
+			return nil, err
+		}
+		if int64(len(m.header)) != headerSize || m.blockSize != blockSize {
+			return nil, ErrInvalidObject
+		}
+	}
+	f := &CASFile{
+		store: s,
+		name:  name,
+	}
+	if f.key, err = NewSecureBuffer(len(key)); err != nil {
+		return nil, err
+	}
+	copy(f.key.Bytes(), key)
+	f.cachedFile = newCachedFile(f, headerSize, blockSize)
+	if m == nil {
+		return f, nil
+	}
+	f.size, f.hashes = m.size, m.hashes
+	copy(f.header, m.header)
+	return f, nil
+}
+
+// hash returns the keyed hash of block d.
+func (f *CASFile) hash(d []byte) []byte {
+	mac := hmac.New(sha256.New, f.key.Bytes())
+	mac.Write(d)
+	return mac.Sum(nil)
+}
+
+// load returns the content of block n, or nil if it is a hole.
+func (f *CASFile) load(n int64) ([]byte, error) {
+	h := f.hashes[n]
+	if isZero(h) {
+		return nil, nil
+	}
+	d, err := f.store.get(h)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(f.hash(d), h) {
+		return nil, ErrHashMismatch
+	}
+	return d, nil
+}
+
+// resize changes the number of blocks to num.
+func (f *CASFile) resize(num int64) {
+	if num < int64(len(f.hashes)) {
+		f.hashes = f.hashes[:num]
+	}
+	for int64(len(f.hashes)) < num {
+		f.hashes = append(f.hashes, make([]byte, casHashSize))
+	}
+}
+
+// save stores the changed blocks and replaces the manifest.
+func (f *CASFile) save(size int64, header []byte, changed map[int64][]byte) error {
+	f.store.mu.RLock()
+	defer f.store.mu.RUnlock()
+	hashes := slices.Clone(f.hashes)
+	for n, d := range changed {
+		if isZero(d) {
+			hashes[n] = make([]byte, casHashSize)
+			continue
+		}
+		hashes[n] = f.hash(d)
+		if err := f.store.put(hashes[n], d); err != nil {
+			return err
+		}
+	}
+	m := casManifest{size: size, blockSize: f.objectSize, header: header, hashes: hashes}
+	if err := writeFile(f.store.manifestPath(f.name), m.encode()); err != nil {
+		return err
+	}
+	f.hashes = hashes
+	return nil
+}
+
+// close wipes the key from memory.
+func (f *CASFile) close() {
+	f.key.Destroy()
+}
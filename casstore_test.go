@@ -0,0 +1,104 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestCASStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenCASStore(dir)
+	if err != nil {
+		t.Fatalf("OpenCASStore: %s", err)
+	}
+	objects := func() int {
+		n := 0
+		filepath.WalkDir(filepath.Join(dir, "objects"), func(path string, e fs.DirEntry, err error) error {
+			if err == nil && e.Type().IsRegular() {
+				n++
+			}
+			return err
+		})
+		return n
+	}
+	transform := new(TestTransform)
+	// Ten blocks, of which blocks 0 and 5 are equal
+	d := make([]byte, 32*10)
+	rand.New(rand.NewSource(1)).Read(d)
+	copy(d[32*5:], d[:32])
+	write := func(name string, key []byte) {
+		f, err := store.OpenCASFile(name, key, 48, 96)
+		if err != nil {
+			t.Fatalf("OpenCASFile: %s", err)
+		}
+		bfile, err := NewBlockFile(f, transform)
+		if err != nil {
+			t.Fatalf("NewBlockFile: %s", err)
+		}
+		sfile := NewStreamFile(bfile)
+		if _, err := sfile.Write(d); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if err := sfile.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	write("v1", key)
+	if n := objects(); n != 9 {
+		t.Errorf("Objects: %d!=%d", n, 9)
+	}
+	write("v2", key)
+	if n := objects(); n != 9 {
+		t.Errorf("Objects after copy: %d!=%d", n, 9)
+	}
+	write("other", bytes.Repeat([]byte{2}, 32))
+	if n := objects(); n != 18 {
+		t.Errorf("Objects with other key: %d!=%d", n, 18)
+	}
+	if f, err := store.OpenCASFile("v2", bytes.Repeat([]byte{2}, 32), 48, 96); err != nil {
+		t.Fatalf("OpenCASFile: %s", err)
+	} else if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	} else if f.key.Len() != 0 {
+		t.Error("Key not destroyed by Close")
+	}
+	for _, name := range []string{"v1", "other"} {
+		if err := store.Remove(name); err != nil {
+			t.Fatalf("Remove: %s", err)
+		}
+	}
+	if n, err := store.GC(); err != nil {
+		t.Fatalf("GC: %s", err)
+	} else if n != 9 {
+		t.Errorf("Removed objects: %d!=%d", n, 9)
+	}
+	f, err := store.OpenCASFile("v2", key, 48, 96)
+	if err != nil {
+		t.Fatalf("OpenCASFile: %s", err)
+	}
+	bfile, err := NewBlockFile(f, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	defer sfile.Close()
+	td := make([]byte, len(d))
+	if _, err := io.ReadFull(sfile, td); err != nil {
+		t.Fatalf("Read: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Errorf("False data:\n\t%x\n\t%x", d, td)
+	}
+	// Reading with the wrong key detects the mismatch
+	if f, err = store.OpenCASFile("v2", bytes.Repeat([]byte{2}, 32), 48, 96); err != nil {
+		t.Fatalf("OpenCASFile: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(td[:10], 48); err != ErrHashMismatch {
+		t.Errorf("ReadAt with wrong key: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// uniform returns true if all bytes of d are equal, that is, d has not been torn by a concurrent write.
+func uniform(d []byte) bool {
+	return len(d) == 0 || bytes.Count(d, d[:1]) == len(d)
+}
+
+func TestBlockFileConcurrency(t *testing.T) {
+	transform := new(TestTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	const blocks = 8
+	for i := int64(0); i < blocks; i++ {
+		if err := bfile.WriteBlockAt(i, bytes.Repeat([]byte{0}, transform.DataSize())); err != nil {
+			t.Fatalf("WriteBlockAt: %s", err)
+		}
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 200; i++ {
+				n := r.Int63n(blocks)
+				switch r.Intn(5) {
+				case 0:
+					if err := bfile.WriteBlockAt(n, bytes.Repeat([]byte{byte(g)}, transform.DataSize())); err != nil {
+						t.Errorf("WriteBlockAt: %s", err)
+					}
+				case 1:
+					if err := bfile.Sync(); err != nil {
+						t.Errorf("Sync: %s", err)
+					}
+				case 2:
+					if c, err := bfile.NumBlocks(); err != nil || c != blocks {
+						t.Errorf("NumBlocks: %d %v", c, err)
+					}
+				default:
+					if d, err := bfile.ReadBlockAt(n, nil); err != nil {
+						t.Errorf("ReadBlockAt: %s", err)
+					} else if !uniform(d) {
+						t.Errorf("Torn block %d: %x", n, d)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestStreamFileConcurrency(t *testing.T) {
+	transform := new(TestTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	sfile.SetCacheSize(3)
+	const size = 32 * 10
+	if _, err := sfile.WriteAt(make([]byte, size), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			d := make([]byte, 32)
+			for i := 0; i < 200; i++ {
+				off := r.Int63n(size/32) * 32
+				switch r.Intn(6) {
+				case 0:
+					if _, err := sfile.WriteAt(bytes.Repeat([]byte{byte(g)}, 32), off); err != nil {
+						t.Errorf("WriteAt: %s", err)
+					}
+				case 1:
+					if err := sfile.Sync(); err != nil {
+						t.Errorf("Sync: %s", err)
+					}
+				case 2:
+					if _, err := sfile.Seek(off, io.SeekStart); err != nil {
+						t.Errorf("Seek: %s", err)
+					}
+					if _, err := sfile.Read(d[:1]); err != nil {
+						t.Errorf("Read: %s", err)
+					}
+				default:
+					if _, err := sfile.ReadAt(d, off); err != nil {
+						t.Errorf("ReadAt: %s", err)
+					} else if !uniform(d) {
+						t.Errorf("Torn block at %d: %x", off, d)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if n := sfile.cache.lru.Len(); n != 0 {
+		t.Errorf("Cache not destroyed: %d entries", n)
+	}
+}
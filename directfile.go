@@ -0,0 +1,255 @@
+package fullfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// DirectAlignment is the alignment of offsets, lengths and memory of direct I/O. It is the default alignment of the
+// layout of files opened with OpenOptions.Direct, so that each block is written as whole sectors.
+const DirectAlignment = 4096
+
+// DirectFile is a file opened for direct I/O, bypassing the page cache, where supported (O_DIRECT on Linux).
+// Transfers go through aligned buffers. Writes that do not cover whole sectors read the sectors and write them back,
+// so aligned layouts should be used for performance. If direct I/O is not supported by the platform or the file
+// system, DirectFile falls back to normal I/O, also if the file system only rejects the first read or write, for
+// example because it needs a larger alignment. DirectFile is safe for concurrent use.
+type DirectFile struct {
+	f      *os.File
+	direct atomic.Bool
+	rw     sync.RWMutex // held exclusively by writes of partial sectors and when falling back to normal I/O.
+	mu     sync.Mutex   // protects pos.
+	pos    int64
+	bufs   sync.Pool // *[]byte aligned buffers.
+}
+
+// OpenDirectFile opens the named file for direct I/O, like os.OpenFile. If direct I/O is not supported, the file is
+// opened normally.
+func OpenDirectFile(name string, flag int, perm os.FileMode) (*DirectFile, error) {
+	if oDirect != 0 {
+		f, err := os.OpenFile(name, flag|oDirect, perm)
+		if err == nil {
+			df := &DirectFile{f: f}
+			df.direct.Store(true)
+			return df, nil
+		} else if !errors.Is(err, syscall.EINVAL) {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectFile{f: f}, nil
+}
+
+// Direct returns true if the file uses direct I/O.
+func (f *DirectFile) Direct() bool {
+	return f.direct.Load()
+}
+
+// fallback switches to normal I/O if err is EINVAL from direct I/O, and returns true if the failed operation should be
+// repeated. If switching fails, an error explaining err is returned.
+func (f *DirectFile) fallback(err error) (bool, error) {
+	if !errors.Is(err, syscall.EINVAL) || !f.direct.Load() {
+		return false, err
+	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.direct.Load() {
+		if cerr := clearDirect(f.f); cerr != nil {
+			return false, fmt.Errorf("direct I/O rejected by the file system: %w", err)
+		}
+		f.direct.Store(false)
+	}
+	return true, nil
+}
+
+// aligned returns true if p, its length and off are aligned for direct I/O.
+func aligned(p []byte, off int64) bool {
+	return off%DirectAlignment == 0 && len(p)%DirectAlignment == 0 &&
+		(len(p) == 0 || uintptr(unsafe.Pointer(&p[0]))%DirectAlignment == 0)
+}
+
+// getBuf returns an aligned buffer of size bytes, a multiple of DirectAlignment. It must be returned with f.bufs.Put.
+func (f *DirectFile) getBuf(size int) *[]byte {
+	if buf, ok := f.bufs.Get().(*[]byte); ok && cap(*buf) >= size {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	b := make([]byte, size+DirectAlignment)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % DirectAlignment); rem != 0 {
+		off = DirectAlignment - rem
+	}
+	b = b[off : off+size]
+	return &b
+}
+
+// sectors returns the aligned range covering len bytes at off.
+func sectors(off int64, n int) (start, end int64) {
+	start = off / DirectAlignment * DirectAlignment
+	end = (off + int64(n) + DirectAlignment - 1) / DirectAlignment * DirectAlignment
+	return start, end
+}
+
+// ReadAt reads len(p) bytes at offset off. It implements io.ReaderAt.
+func (f *DirectFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.readDirect(p, off)
+	retry, err := f.fallback(err)
+	if retry {
+		return f.readDirect(p, off)
+	}
+	return n, err
+}
+
+// readDirect reads len(p) bytes at offset off, through an aligned buffer if necessary.
+func (f *DirectFile) readDirect(p []byte, off int64) (int, error) {
+	if !f.direct.Load() || aligned(p, off) {
+		return f.f.ReadAt(p, off)
+	}
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	return f.readAt(p, off)
+}
+
+// readAt reads unaligned p through an aligned buffer.
+func (f *DirectFile) readAt(p []byte, off int64) (int, error) {
+	start, end := sectors(off, len(p))
+	buf := f.getBuf(int(end - start))
+	defer f.bufs.Put(buf)
+	m, err := f.f.ReadAt(*buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	n := 0
+	if avail := start + int64(m) - off; avail > 0 {
+		n = copy(p, (*buf)[off-start:int64(m)])
+	}
+	clear(*buf)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off. It implements io.WriterAt.
+func (f *DirectFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.writeDirect(p, off)
+	retry, err := f.fallback(err)
+	if retry {
+		return f.writeDirect(p, off)
+	}
+	return n, err
+}
+
+// writeDirect writes p at offset off, through an aligned buffer if necessary.
+func (f *DirectFile) writeDirect(p []byte, off int64) (int, error) {
+	if !f.direct.Load() || aligned(p, off) {
+		f.rw.RLock()
+		defer f.rw.RUnlock()
+		return f.f.WriteAt(p, off)
+	}
+	start, end := sectors(off, len(p))
+	if off == start && int64(len(p)) == end-start {
+		// Whole sectors from unaligned memory.
+		buf := f.getBuf(len(p))
+		defer f.bufs.Put(buf)
+		copy(*buf, p)
+		f.rw.RLock()
+		defer f.rw.RUnlock()
+		return f.f.WriteAt(*buf, off)
+	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	fi, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	buf := f.getBuf(int(end - start))
+	defer f.bufs.Put(buf)
+	m, err := f.f.ReadAt(*buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	clear((*buf)[m:])
+	copy((*buf)[off-start:], p)
+	if _, err := f.f.WriteAt(*buf, start); err != nil {
+		return 0, err
+	}
+	if newSize := max(size, off+int64(len(p))); newSize < end {
+		if err := f.f.Truncate(newSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Read reads from the current position.
+func (f *DirectFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current position.
+func (f *DirectFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the current position.
+func (f *DirectFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		fi, err := f.f.Stat()
+		if err != nil {
+			return f.pos, err
+		}
+		offset += fi.Size()
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+// Truncate changes the size of the file.
+func (f *DirectFile) Truncate(size int64) error {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	return f.f.Truncate(size)
+}
+
+// Sync flushes the file to stable storage.
+func (f *DirectFile) Sync() error {
+	return f.f.Sync()
+}
+
+// Close closes the file.
+func (f *DirectFile) Close() error {
+	return f.f.Close()
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package fullfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// oDirect is the flag that opens files for direct I/O.
+const oDirect = syscall.O_DIRECT
+
+// clearDirect switches f from direct I/O to normal I/O.
+func clearDirect(f *os.File) error {
+	fd := f.Fd()
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFL, flags&^syscall.O_DIRECT); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package fullfile
+
+import (
+	"errors"
+	"os"
+)
+
+// oDirect is 0, since direct I/O is not supported on this platform.
+const oDirect = 0
+
+// clearDirect is not supported on this platform.
+func clearDirect(f *os.File) error {
+	return errors.ErrUnsupported
+}
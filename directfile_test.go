@@ -0,0 +1,115 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "direct")
+	f, err := OpenDirectFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenDirectFile: %s", err)
+	}
+	defer f.Close()
+	t.Logf("Direct I/O: %v", f.Direct())
+	d := make([]byte, 3*DirectAlignment)
+	rand.New(rand.NewSource(1)).Read(d)
+	// Whole sectors, partial sectors and an unaligned extension
+	if _, err := f.WriteAt(d[1:DirectAlignment+1], DirectAlignment); err != nil {
+		t.Fatalf("WriteAt aligned: %s", err)
+	}
+	if _, err := f.WriteAt(d[:100], 10); err != nil {
+		t.Fatalf("WriteAt partial: %s", err)
+	}
+	if _, err := f.WriteAt(d[:5000], 2*DirectAlignment+7); err != nil {
+		t.Fatalf("WriteAt extension: %s", err)
+	}
+	expect := make([]byte, 2*DirectAlignment+7+5000)
+	copy(expect[DirectAlignment:], d[1:DirectAlignment+1])
+	copy(expect[10:], d[:100])
+	copy(expect[2*DirectAlignment+7:], d[:5000])
+	if size, err := f.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %s", err)
+	} else if size != int64(len(expect)) {
+		t.Errorf("Size: %d!=%d", size, len(expect))
+	}
+	td := make([]byte, len(expect)+10)
+	if n, err := f.ReadAt(td, 0); err != io.EOF || n != len(expect) {
+		t.Errorf("ReadAt past end: %d %v", n, err)
+	} else if !bytes.Equal(td[:n], expect) {
+		t.Error("False data")
+	}
+	f.Seek(3, io.SeekStart)
+	if _, err := io.ReadFull(f, td[:50]); err != nil {
+		t.Fatalf("Read: %s", err)
+	} else if !bytes.Equal(td[:50], expect[3:53]) {
+		t.Error("False data read")
+	}
+}
+
+func TestBlockFileDirect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	transform := new(TestTransform)
+	bfile, err := OpenBlockFile(path, transform, &OpenOptions{Direct: true})
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := make([]byte, 32*10+5)
+	rand.New(rand.NewSource(2)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf("Stat: %s", err)
+	} else if fi.Size() != DirectAlignment*12 {
+		t.Errorf("File size: %d!=%d", fi.Size(), DirectAlignment*12)
+	}
+	if bfile, err = OpenBlockFile(path, transform, &OpenOptions{Direct: true, ReadOnly: true}); err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	td := make([]byte, len(d))
+	if _, err := io.ReadFull(sfile, td); err != nil {
+		t.Fatalf("Read: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Errorf("False data:\n\t%x\n\t%x", d, td)
+	}
+}
+
+// TestDirectFileFallback switches to normal I/O after direct I/O has been rejected.
+func TestDirectFileFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "direct")
+	f, err := OpenDirectFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenDirectFile: %s", err)
+	}
+	defer f.Close()
+	if !f.Direct() {
+		t.Skip("Direct I/O not supported")
+	}
+	// Unaligned direct I/O is rejected like by a file system that needs a larger alignment
+	d := make([]byte, DirectAlignment+1)[1:]
+	_, err = f.f.WriteAt(d, 0)
+	if retry, err := f.fallback(err); err != nil || !retry {
+		t.Fatalf("fallback: %t %v", retry, err)
+	}
+	if f.Direct() {
+		t.Error("Direct I/O after fallback")
+	}
+	if _, err := f.f.WriteAt(d, 1); err != nil {
+		t.Errorf("WriteAt after fallback: %s", err)
+	}
+	if retry, err := f.fallback(os.ErrInvalid); err != os.ErrInvalid || retry {
+		t.Errorf("fallback for other error: %t %v", retry, err)
+	}
+}
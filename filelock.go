@@ -0,0 +1,77 @@
+package fullfile
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	// lockSuffix is appended to the path of a file to name its lock file.
+	lockSuffix = ".lock"
+	// lockRetryMin and lockRetryMax bound the interval between attempts to acquire a busy lock.
+	lockRetryMin = 10 * time.Millisecond
+	lockRetryMax = 500 * time.Millisecond
+)
+
+var (
+	// ErrLocked is returned when a file is opened with OpenOptions.Lock while another BlockFile holds the lock.
+	ErrLocked = errors.New("file is locked")
+)
+
+// fileLock is an advisory lock on a sidecar lock file, that a BlockFile holds for as long as it is open: shared if it
+// is opened read-only, exclusive otherwise. It keeps the BlockFiles of processes opening the same file from accessing
+// it at the same time, whichever backend stores the file.
+type fileLock struct {
+	f *os.File
+}
+
+// openFileLock opens the lock file of the file at path, creating it with perm if it does not exist, and acquires the
+// lock. If the lock is busy, it is tried again until ctx is done, and ErrLocked is returned then. A ctx that is never
+// done, like context.Background(), makes a single attempt. If readOnly is set, the lock file is opened read-only and
+// the lock is acquired shared. A lock file that does not exist and cannot be created, for example in a read-only
+// directory, cannot be used by writers either: the file is then opened without a lock, and nil is returned.
+func openFileLock(ctx context.Context, path string, perm os.FileMode, readOnly bool) (*fileLock, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path+lockSuffix, flag, perm)
+	if readOnly && os.IsNotExist(err) {
+		if f, err = os.OpenFile(path+lockSuffix, flag|os.O_CREATE, perm); err != nil {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	delay := lockRetryMin
+	for {
+		locked, err := tryFlock(f, !readOnly)
+		if err != nil {
+			f.Close()
+			return nil, err
+		} else if locked {
+			return &fileLock{f: f}, nil
+		}
+		if ctx.Done() == nil {
+			f.Close()
+			return nil, ErrLocked
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ErrLocked
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > lockRetryMax {
+			delay = lockRetryMax
+		}
+	}
+}
+
+// close releases the lock and closes the lock file.
+func (l *fileLock) close() error {
+	return l.f.Close()
+}
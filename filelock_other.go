@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package fullfile
+
+import (
+	"errors"
+	"os"
+)
+
+// tryFlock is not supported on this platform.
+func tryFlock(f *os.File, exclusive bool) (bool, error) {
+	return false, errors.ErrUnsupported
+}
@@ -0,0 +1,155 @@
+package fullfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// genTransform keeps a generation counter in the header.
+type genTransform struct {
+	TestTransform
+	gen uint64
+}
+
+func (ttf *genTransform) Init(d []byte) error {
+	if len(d) >= 8 {
+		ttf.gen = binary.BigEndian.Uint64(d)
+	}
+	return nil
+}
+
+func (ttf *genTransform) SyncHeader() ([]byte, error) {
+	header := make([]byte, ttf.HeaderSize())
+	binary.BigEndian.PutUint64(header, ttf.gen)
+	return header, nil
+}
+
+func (ttf *genTransform) Generation() uint64       { return ttf.gen }
+func (ttf *genTransform) SetGeneration(gen uint64) { ttf.gen = gen }
+
+// TestFileLock opens the file in a child process, which has to wait until the parent closes it.
+func TestFileLock(t *testing.T) {
+	if path := os.Getenv("FULLFILE_TEST_LOCK"); path != "" {
+		testFileLockChild(t, path)
+		return
+	}
+	path := filepath.Join(t.TempDir(), "vault")
+	bfile, err := OpenBlockFile(path, new(genTransform), &OpenOptions{Lock: true})
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	writer := NewStreamFile(bfile)
+	if _, err := os.Stat(path + lockSuffix); err != nil {
+		t.Errorf("Lock file: %s", err)
+	}
+	if _, err := writer.WriteAt([]byte("first version"), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if gen := bfile.Generation(); gen != 1 {
+		t.Errorf("Generation: %d!=%d", gen, 1)
+	}
+	// Other opens fail at once, or when the context is done
+	if _, err := OpenBlockFile(path, new(genTransform), &OpenOptions{Lock: true, ReadOnly: true}); err != ErrLocked {
+		t.Errorf("OpenBlockFile while locked: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := OpenBlockFileContext(ctx, path, new(genTransform), &OpenOptions{Lock: true}); err != ErrLocked {
+		t.Errorf("OpenBlockFileContext while locked: %v", err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileLock$", "-test.v")
+	cmd.Env = append(os.Environ(), "FULLFILE_TEST_LOCK="+path)
+	out := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := writer.WriteAt([]byte("second version"), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	// Syncing without changes keeps the generation
+	if err := writer.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Child: %s\n%s", err, out.Bytes())
+	}
+	// Read-only opens create a missing lock file
+	if err := os.Remove(path + lockSuffix); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	if bfile, err = OpenBlockFile(path, new(genTransform), &OpenOptions{Lock: true, ReadOnly: true}); err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	defer bfile.Close()
+	if _, err := os.Stat(path + lockSuffix); err != nil {
+		t.Errorf("Lock file: %s", err)
+	}
+}
+
+func testFileLockChild(t *testing.T, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	bfile, err := OpenBlockFileContext(ctx, path, new(genTransform), &OpenOptions{Lock: true, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	reader := NewStreamFile(bfile)
+	defer reader.Close()
+	td := make([]byte, 14)
+	if _, err := reader.ReadAt(td, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if string(td) != "second version" {
+		t.Errorf("False data: %q", td)
+	}
+	if gen := bfile.Generation(); gen != 2 {
+		t.Errorf("Generation: %d!=%d", gen, 2)
+	}
+}
+
+// TestStreamFileGeneration changes the BlockFile beneath a StreamFile, which has to drop its cache.
+func TestStreamFileGeneration(t *testing.T) {
+	bfile, err := NewBlockFile(memFiles(t, 1)[0], new(genTransform))
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	defer sfile.Close()
+	if _, err := sfile.WriteAt([]byte("cached version"), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	td := make([]byte, 14)
+	if _, err := sfile.ReadAt(td, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	}
+	if err := bfile.WriteBlockAt(0, []byte("direct version")); err != nil {
+		t.Fatalf("WriteBlockAt: %s", err)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if _, err := sfile.ReadAt(td, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if string(td) != "direct version" {
+		t.Errorf("Stale data: %q", td)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+package fullfile
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// lockfileFailImmediately makes LockFileEx return instead of waiting for a busy lock.
+	lockfileFailImmediately = 0x1
+	// lockfileExclusiveLock requests an exclusive lock from LockFileEx.
+	lockfileExclusiveLock = 0x2
+	// errorLockViolation is returned by LockFileEx for a busy lock.
+	errorLockViolation syscall.Errno = 33
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// tryFlock acquires a lock on a byte far past the end of f, exclusive or shared, if it is available, and returns false
+// otherwise. The lock is mandatory, but does not cover the data of f, which other processes can still read. It is
+// released when f is closed.
+func tryFlock(f *os.File, exclusive bool) (bool, error) {
+	flags := uintptr(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	ol := syscall.Overlapped{OffsetHigh: 0x7fffffff}
+	if r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&ol))); r == 0 {
+		if err == errorLockViolation {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
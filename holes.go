@@ -0,0 +1,77 @@
+package fullfile
+
+import (
+	"math"
+	"sort"
+)
+
+// holeExtent is a run of holes, from block start up to end.
+type holeExtent struct {
+	start, end int64
+}
+
+// holeExtents are the holes a BlockFile created since it was opened, as sorted runs that neither overlap nor touch.
+type holeExtents []holeExtent
+
+// find returns the index of the first extent that ends after n.
+func (h holeExtents) find(n int64) int {
+	return sort.Search(len(h), func(i int) bool { return h[i].end > n })
+}
+
+// has returns true if block n is a hole.
+func (h holeExtents) has(n int64) bool {
+	i := h.find(n)
+	return i < len(h) && h[i].start <= n
+}
+
+// add marks the blocks from start up to end as holes.
+func (h *holeExtents) add(start, end int64) {
+	if start >= end {
+		return
+	}
+	s := *h
+	i := sort.Search(len(s), func(i int) bool { return s[i].end >= start })
+	j := i
+	for ; j < len(s) && s[j].start <= end; j++ {
+		start, end = min64(start, s[j].start), max(end, s[j].end)
+	}
+	*h = append(s[:i], append([]holeExtent{{start, end}}, s[j:]...)...)
+}
+
+// remove marks the blocks from start up to end as written.
+func (h *holeExtents) remove(start, end int64) {
+	if start >= end {
+		return
+	}
+	s := *h
+	i := s.find(start)
+	var kept []holeExtent
+	j := i
+	for ; j < len(s) && s[j].start < end; j++ {
+		if s[j].start < start {
+			kept = append(kept, holeExtent{s[j].start, start})
+		}
+		if s[j].end > end {
+			kept = append(kept, holeExtent{end, s[j].end})
+		}
+	}
+	if i == j {
+		return
+	}
+	*h = append(s[:i], append(kept, s[j:]...)...)
+}
+
+// truncate drops the holes from block n on.
+func (h *holeExtents) truncate(n int64) {
+	h.remove(n, math.MaxInt64)
+}
+
+// allZero returns true if all bytes of d are zero.
+func allZero(d []byte) bool {
+	for _, b := range d {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
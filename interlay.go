@@ -1,24 +1,56 @@
 package fullfile
 
+import (
+	"errors"
+)
+
 /* Interlay calculation */
 
+var (
+	// ErrInvalidInterlay is returned for an Interlay with invalid sizes.
+	ErrInvalidInterlay = errors.New("invalid interlay")
+)
+
 // Interlay is the description of an interlayed stream that contains a header, and blocks of data surrounded by prefix and postfix bytes.
 // It serves to calculate the positions of all elements for a given byte position in the stream.
+// The fields must not be changed after the first calculation.
 type Interlay struct {
 	HeaderSize  int64 // Headers always start at byte 0 in the underlying bytefield.
 	PrefixSize  int64 // Prefixes always preceed a block of data and are present for each block.
 	PostfixSize int64 // Postfixes always follow a block of data and are present for each block.
 	DataSize    int64 // Blocks are fixed sized.
+	Align       int64 // If greater than 1, the header and each slice are padded to a multiple of Align.
 
 	preCalculated bool
 	sliceLen      int64
 	postfixPos    int64
-	blockPos      int64
+	payloadPos    int64
+	stride        int64
 }
 
 func (in *Interlay) preCalc() {
 	in.sliceLen = (in.PrefixSize + in.DataSize + in.PostfixSize)
 	in.postfixPos = in.PrefixSize + in.DataSize
+	in.payloadPos = in.align(in.HeaderSize)
+	in.stride = in.align(in.sliceLen)
+	in.preCalculated = true
+}
+
+// align rounds n up to a multiple of Align.
+func (in *Interlay) align(n int64) int64 {
+	if in.Align <= 1 {
+		return n
+	}
+	return (n + in.Align - 1) / in.Align * in.Align
+}
+
+// Validate returns ErrInvalidInterlay if a size is negative, or if there is no data in a block.
+func (in *Interlay) Validate() error {
+	if in.HeaderSize < 0 || in.PrefixSize < 0 || in.PostfixSize < 0 || in.DataSize <= 0 || in.Align < 0 {
+		return ErrInvalidInterlay
+	}
+	in.preCalc()
+	return nil
 }
 
 // SliceLen returns the size of a slice containing postfix, data and prefix.
@@ -29,6 +61,14 @@ func (in *Interlay) SliceLen() int64 {
 	return in.sliceLen
 }
 
+// Stride returns the distance between the starts of two consecutive slices, that is SliceLen plus padding.
+func (in *Interlay) Stride() int64 {
+	if !in.preCalculated {
+		in.preCalc()
+	}
+	return in.stride
+}
+
 // DataPosition returns the position of the first byte of data in the block slice (that is, the PrefixSize).
 func (in *Interlay) DataPosition() int64 {
 	return in.PrefixSize
@@ -42,9 +82,12 @@ func (in *Interlay) PostfixPosition() int64 {
 	return in.postfixPos
 }
 
-// PayloadPosition returns the byte position following the header.
+// PayloadPosition returns the byte position following the header and its padding.
 func (in *Interlay) PayloadPosition() int64 {
-	return in.HeaderSize
+	if !in.preCalculated {
+		in.preCalc()
+	}
+	return in.payloadPos
 }
 
 // GetBlock returns the block of the byte at position pos.
@@ -58,5 +101,48 @@ func (in *Interlay) GetReadSlice(block int64) (readPos, sliceLen int64) {
 	if !in.preCalculated {
 		in.preCalc()
 	}
-	return in.HeaderSize + block*in.sliceLen, in.sliceLen
+	return in.payloadPos + block*in.stride, in.sliceLen
+}
+
+// GetReadRange returns the position of the first byte to read from the underlying stream for count consecutive
+// blocks starting at block, and the length of the range, including the padding between the slices.
+func (in *Interlay) GetReadRange(block, count int64) (readPos, rangeLen int64) {
+	if !in.preCalculated {
+		in.preCalc()
+	}
+	if count <= 0 {
+		return in.payloadPos + block*in.stride, 0
+	}
+	return in.payloadPos + block*in.stride, (count-1)*in.stride + in.sliceLen
+}
+
+// Locate converts the position pos in the data to the block containing it, the offset in the data of that block,
+// and the position of the byte in the underlying stream.
+func (in *Interlay) Locate(pos int64) (block, offset, physical int64) {
+	if !in.preCalculated {
+		in.preCalc()
+	}
+	block = pos / in.DataSize
+	offset = pos % in.DataSize
+	return block, offset, in.payloadPos + block*in.stride + in.PrefixSize + offset
+}
+
+// EndPosition returns the size of an underlying stream with blocks complete slices, including the padding of the last.
+func (in *Interlay) EndPosition(blocks int64) int64 {
+	if !in.preCalculated {
+		in.preCalc()
+	}
+	return in.payloadPos + blocks*in.stride
+}
+
+// Blocks returns the number of complete slices in an underlying stream of size bytes. The padding of the last slice
+// may be missing.
+func (in *Interlay) Blocks(size int64) int64 {
+	if !in.preCalculated {
+		in.preCalc()
+	}
+	if size < in.payloadPos+in.sliceLen {
+		return 0
+	}
+	return (size-in.payloadPos-in.sliceLen)/in.stride + 1
 }
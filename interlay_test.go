@@ -0,0 +1,102 @@
+package fullfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInterlay(t *testing.T) {
+	in := &Interlay{HeaderSize: 10, PrefixSize: 4, PostfixSize: 16, DataSize: 32, Align: 16}
+	if err := in.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	if in.PayloadPosition() != 16 || in.SliceLen() != 52 || in.Stride() != 64 {
+		t.Errorf("Layout: payload %d, slice %d, stride %d", in.PayloadPosition(), in.SliceLen(), in.Stride())
+	}
+	if block, offset, physical := in.Locate(70); block != 2 || offset != 6 || physical != 16+2*64+4+6 {
+		t.Errorf("Locate: %d %d %d", block, offset, physical)
+	}
+	if pos, l := in.GetReadRange(1, 3); pos != 80 || l != 2*64+52 {
+		t.Errorf("GetReadRange: %d %d", pos, l)
+	}
+	for _, n := range []int64{0, 1, 5} {
+		if blocks := in.Blocks(in.EndPosition(n)); blocks != n {
+			t.Errorf("Blocks of EndPosition(%d): %d", n, blocks)
+		}
+	}
+	if blocks := in.Blocks(in.EndPosition(2) - 12); blocks != 2 {
+		t.Errorf("Blocks without trailing padding: %d!=%d", blocks, 2)
+	}
+	if err := (&Interlay{DataSize: 0}).Validate(); err != ErrInvalidInterlay {
+		t.Errorf("Validate empty: %v", err)
+	}
+}
+
+// alignedTransform pads the header and the blocks of TestTransform to 64 bytes.
+type alignedTransform struct {
+	TestTransform
+}
+
+func (ttf *alignedTransform) Interlay() Interlay {
+	return Interlay{
+		HeaderSize: int64(ttf.HeaderSize()),
+		DataSize:   int64(ttf.BlockSize()),
+		Align:      64,
+	}
+}
+
+func TestBlockFileInterlay(t *testing.T) {
+	transform := new(alignedTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	blocks := make([][]byte, 5)
+	for i := range blocks {
+		blocks[i] = bytes.Repeat([]byte{byte(i + 1)}, transform.DataSize())
+	}
+	if err := bfile.WriteBlocks(0, blocks[:3]); err != nil {
+		t.Fatalf("WriteBlocks: %s", err)
+	}
+	for i := int64(3); i < 5; i++ {
+		if err := bfile.WriteBlockAt(i, blocks[i]); err != nil {
+			t.Fatalf("WriteBlockAt: %s", err)
+		}
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if size := files[0].Len(); size != 64+5*128 {
+		t.Errorf("File size: %d!=%d", size, 64+5*128)
+	}
+	raw := make([]byte, 96)
+	if _, err := files[0].ReadAt(raw, 64+128); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if !bytes.Equal(raw[32:64], blocks[1]) {
+		t.Errorf("Block not aligned:\n\t%x\n\t%x", blocks[1], raw[32:64])
+	}
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 5 {
+		t.Errorf("NumBlocks: %d!=%d", n, 5)
+	}
+	d, err := bfile.ReadBlocks(1, 4, nil)
+	if err != nil {
+		t.Fatalf("ReadBlocks: %s", err)
+	}
+	for i := range d {
+		if !bytes.Equal(d[i], blocks[1+i]) {
+			t.Errorf("False data %d:\n\t%x\n\t%x", 1+i, blocks[1+i], d[i])
+		}
+	}
+	if err := bfile.Truncate(2); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if size := files[0].Len(); size != 64+2*128 {
+		t.Errorf("File size after Truncate: %d!=%d", size, 64+2*128)
+	}
+	if err := bfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
@@ -0,0 +1,443 @@
+package fullfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+/*
+Journal format:
+  - Magic "DPJ1"
+  - Base (int64): the file is truncated to Base before applying the extents.
+  - Size (int64): the size of the file after applying the extents.
+  - Count (uint32): the number of extents.
+  - Extents: Offset (int64), Length (uint32), data.
+  - SHA256 of all preceding bytes.
+*/
+
+const (
+	journalPageSize = 4096
+	journalMagic    = "DPJ1"
+)
+
+var (
+	// ErrJournalCorrupt is returned when a journal cannot be parsed. A journal that fails verification is not an error,
+	// it is an incomplete commit that is rolled back.
+	ErrJournalCorrupt = errors.New("journal corrupt")
+)
+
+// Journal makes changes to an underlying file atomic. All writes are kept in memory until Sync, which first writes
+// them to a separate journal file and then applies them to the underlying file. If the process crashes before the
+// journal is complete, the underlying file is unchanged. If it crashes afterwards, the journal is replayed by
+// NewJournal. Together with a BlockFile this guarantees that blocks and header always match.
+// Journal is safe for concurrent use.
+type Journal struct {
+	mu       sync.Mutex
+	file     ReadWriteCloseSeeker
+	journal  ReadWriteCloseSeeker
+	pages    map[int64][]byte // modified pages by page number.
+	pos      int64            // the current seek position.
+	size     int64            // the logical size of the file.
+	base     int64            // data of file from base on is discarded on commit.
+	fileSize int64            // the size of file.
+}
+
+// journalExtent is a range of data to write to the underlying file.
+type journalExtent struct {
+	off  int64
+	data []byte
+}
+
+// NewJournal returns a Journal for file that uses journal for pending changes. A complete journal from a previous
+// session is replayed, an incomplete one is discarded.
+func NewJournal(file, journal ReadWriteCloseSeeker) (*Journal, error) {
+	j := &Journal{
+		file:    file,
+		journal: journal,
+		pages:   make(map[int64][]byte),
+	}
+	if err := j.recover(); err != nil {
+		return nil, err
+	}
+	size, err := fileSize(file)
+	if err != nil {
+		return nil, err
+	}
+	j.size, j.base, j.fileSize = size, size, size
+	return j, nil
+}
+
+// NewJournaledBlockFile opens f as BlockFile with a Journal that uses journal for pending changes. Changes to blocks
+// and header become visible in f atomically on Sync and Close.
+func NewJournaledBlockFile(f, journal ReadWriteCloseSeeker, transform Transform) (*BlockFile, error) {
+	j, err := NewJournal(f, journal)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockFile(j, transform)
+}
+
+// recover replays a complete journal.
+func (j *Journal) recover() error {
+	size, err := fileSize(j.journal)
+	if err != nil {
+		return err
+	}
+	if size < int64(len(journalMagic)) {
+		return nil
+	}
+	d := make([]byte, size)
+	if _, err := readFullAt(j.journal, d, 0); err != nil {
+		return err
+	}
+	base, newSize, extents, err := decodeJournal(d)
+	if err == ErrJournalCorrupt {
+		return j.clearJournal()
+	} else if err != nil {
+		return err
+	}
+	if err := j.apply(context.Background(), base, newSize, extents); err != nil {
+		return err
+	}
+	return j.clearJournal()
+}
+
+// encodeJournal returns the journal record for the given changes.
+func encodeJournal(base, size int64, extents []journalExtent) []byte {
+	var b bytes.Buffer
+	b.WriteString(journalMagic)
+	binary.Write(&b, binary.BigEndian, base)
+	binary.Write(&b, binary.BigEndian, size)
+	binary.Write(&b, binary.BigEndian, uint32(len(extents)))
+	for _, e := range extents {
+		binary.Write(&b, binary.BigEndian, e.off)
+		binary.Write(&b, binary.BigEndian, uint32(len(e.data)))
+		b.Write(e.data)
+	}
+	sum := sha256.Sum256(b.Bytes())
+	b.Write(sum[:])
+	return b.Bytes()
+}
+
+// decodeJournal parses and verifies a journal record. It returns ErrJournalCorrupt if d is not a complete record.
+func decodeJournal(d []byte) (base, size int64, extents []journalExtent, err error) {
+	if len(d) < len(journalMagic)+8+8+4+sha256.Size || string(d[:len(journalMagic)]) != journalMagic {
+		return 0, 0, nil, ErrJournalCorrupt
+	}
+	r := bytes.NewReader(d[len(journalMagic):])
+	var count uint32
+	binary.Read(r, binary.BigEndian, &base)
+	binary.Read(r, binary.BigEndian, &size)
+	binary.Read(r, binary.BigEndian, &count)
+	for i := uint32(0); i < count; i++ {
+		var e journalExtent
+		var l uint32
+		if binary.Read(r, binary.BigEndian, &e.off) != nil || binary.Read(r, binary.BigEndian, &l) != nil {
+			return 0, 0, nil, ErrJournalCorrupt
+		}
+		if int64(l) > int64(r.Len()) {
+			return 0, 0, nil, ErrJournalCorrupt
+		}
+		e.data = make([]byte, l)
+		r.Read(e.data)
+		extents = append(extents, e)
+	}
+	end := len(d) - r.Len()
+	if r.Len() < sha256.Size {
+		return 0, 0, nil, ErrJournalCorrupt
+	}
+	if sum := sha256.Sum256(d[:end]); !bytes.Equal(sum[:], d[end:end+sha256.Size]) {
+		return 0, 0, nil, ErrJournalCorrupt
+	}
+	return base, size, extents, nil
+}
+
+// apply writes changes to the underlying file and syncs it. Discarded data is wiped before truncation. apply is
+// idempotent, so that an interrupted apply can be repeated. It stops with the error of ctx if ctx is done before an
+// extent is written.
+func (j *Journal) apply(ctx context.Context, base, size int64, extents []journalExtent) error {
+	t, canTruncate := j.file.(truncater)
+	current, err := fileSize(j.file)
+	if err != nil {
+		return err
+	}
+	if base < current {
+		if !canTruncate {
+			return errors.ErrUnsupported
+		}
+		if err := wipeRange(ctx, j.file, base, current); err != nil {
+			return err
+		}
+		if err := t.Truncate(base); err != nil {
+			return err
+		}
+	}
+	for _, e := range extents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := writeFullAt(j.file, e.data, e.off); err != nil {
+			return err
+		}
+	}
+	if canTruncate {
+		if err := t.Truncate(size); err != nil {
+			return err
+		}
+	}
+	if s, ok := j.file.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// clearJournal invalidates the journal, truncating it if possible.
+func (j *Journal) clearJournal() error {
+	if t, ok := j.journal.(truncater); ok {
+		if err := t.Truncate(0); err != nil {
+			return err
+		}
+	} else if _, err := writeFullAt(j.journal, make([]byte, len(journalMagic)), 0); err != nil {
+		return err
+	}
+	if s, ok := j.journal.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// readBase reads from the underlying file. Data that is discarded or beyond its end reads as zeros.
+func (j *Journal) readBase(p []byte, off int64) error {
+	clear(p)
+	limit := min64(j.fileSize, j.base)
+	if off >= limit {
+		return nil
+	}
+	if off+int64(len(p)) > limit {
+		p = p[:limit-off]
+	}
+	_, err := readFullAt(j.file, p, off)
+	return err
+}
+
+// page returns the modified page n, loading it from the underlying file if necessary.
+func (j *Journal) page(n int64) ([]byte, error) {
+	if d, ok := j.pages[n]; ok {
+		return d, nil
+	}
+	d := make([]byte, journalPageSize)
+	if err := j.readBase(d, n*journalPageSize); err != nil {
+		return nil, err
+	}
+	j.pages[n] = d
+	return d, nil
+}
+
+// ReadAt reads len(p) bytes from offset off into p. It returns io.EOF if fewer bytes are available.
+func (j *Journal) ReadAt(p []byte, off int64) (n int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.readAt(p, off)
+}
+
+func (j *Journal) readAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	for n < len(p) && off+int64(n) < j.size {
+		pos := off + int64(n)
+		po := pos % journalPageSize
+		m := int(min64(min64(int64(len(p)-n), journalPageSize-po), j.size-pos))
+		if d, ok := j.pages[pos/journalPageSize]; ok {
+			copy(p[n:n+m], d[po:])
+		} else if err := j.readBase(p[n:n+m], pos); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off.
+func (j *Journal) WriteAt(p []byte, off int64) (n int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.writeAt(p, off)
+}
+
+func (j *Journal) writeAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	for n < len(p) {
+		pos := off + int64(n)
+		po := pos % journalPageSize
+		d, err := j.page(pos / journalPageSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(d[po:], p[n:])
+	}
+	if off+int64(n) > j.size {
+		j.size = off + int64(n)
+	}
+	return n, nil
+}
+
+// Read reads from the current seek position.
+func (j *Journal) Read(p []byte) (n int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n, err = j.readAt(p, j.pos)
+	j.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current seek position.
+func (j *Journal) Write(p []byte) (n int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n, err = j.writeAt(p, j.pos)
+	j.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the seek position.
+func (j *Journal) Seek(offset int64, whence int) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += j.pos
+	case io.SeekEnd:
+		offset += j.size
+	default:
+		return j.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return j.pos, os.ErrInvalid
+	}
+	j.pos = offset
+	return j.pos, nil
+}
+
+// Truncate changes the size of the file. The underlying file must support Truncate if the file shrinks below the
+// size of the underlying file.
+func (j *Journal) Truncate(size int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size < j.fileSize {
+		if _, ok := j.file.(truncater); !ok {
+			return errors.ErrUnsupported
+		}
+	}
+	for n, d := range j.pages {
+		if n*journalPageSize >= size {
+			delete(j.pages, n)
+		} else if n*journalPageSize+journalPageSize > size {
+			clear(d[size-n*journalPageSize:])
+		}
+	}
+	if size < j.base {
+		j.base = size
+	}
+	j.size = size
+	return nil
+}
+
+// Sync commits all changes: they are written to the journal, applied to the underlying file and the journal is
+// cleared.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.commit(context.Background())
+}
+
+// SyncContext is like Sync, but aborted when ctx is done. If the journal has been written by then, the underlying file
+// may be partially updated; the changes stay pending and are applied completely by the next Sync or, after a crash,
+// by NewJournal.
+func (j *Journal) SyncContext(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.commit(ctx)
+}
+
+func (j *Journal) commit(ctx context.Context) error {
+	if len(j.pages) == 0 && j.size == j.fileSize && j.base == j.fileSize {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pages := make([]int64, 0, len(j.pages))
+	for n := range j.pages {
+		pages = append(pages, n)
+	}
+	sort.Slice(pages, func(a, b int) bool { return pages[a] < pages[b] })
+	extents := make([]journalExtent, 0, len(pages))
+	for _, n := range pages {
+		off := n * journalPageSize
+		extents = append(extents, journalExtent{
+			off:  off,
+			data: j.pages[n][:min64(journalPageSize, j.size-off)],
+		})
+	}
+	if _, err := writeFullAt(j.journal, encodeJournal(j.base, j.size, extents), 0); err != nil {
+		return err
+	}
+	if s, ok := j.journal.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := j.apply(ctx, j.base, j.size, extents); err != nil {
+		return err
+	}
+	if err := j.clearJournal(); err != nil {
+		return err
+	}
+	j.pages = make(map[int64][]byte)
+	j.base, j.fileSize = j.size, j.size
+	return nil
+}
+
+// Close commits all changes and closes the underlying file and the journal.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.commit(context.Background())
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := j.journal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// commitsOnSync marks Journal as committer.
+func (j *Journal) commitsOnSync() {}
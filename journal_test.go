@@ -0,0 +1,170 @@
+package fullfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempFiles(t *testing.T, n int) []*os.File {
+	r := make([]*os.File, n)
+	for i := range r {
+		f, err := ioutil.TempFile("", "testjournal.")
+		if err != nil {
+			t.Fatalf("TempFile: %s", err)
+		}
+		t.Cleanup(func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+		r[i] = f
+	}
+	return r
+}
+
+func TestJournal(t *testing.T) {
+	transform := new(TestTransform)
+	files := tempFiles(t, 2)
+	bfile, err := NewJournaledBlockFile(files[0], files[1], transform)
+	if err != nil {
+		t.Fatalf("NewJournaledBlockFile: %s", err)
+	}
+	if err := bfile.WriteBlock([]byte("Test Block 001")); err != nil {
+		t.Fatalf("WriteBlock: %s", err)
+	}
+	if fi, _ := files[0].Stat(); fi.Size() != 0 {
+		t.Errorf("File written before Sync: %d", fi.Size())
+	}
+	if d, err := bfile.ReadBlockAt(0, nil); err != nil {
+		t.Fatalf("ReadBlockAt: %s", err)
+	} else if !bytes.HasPrefix(d, []byte("Test Block 001")) {
+		t.Errorf("False data: %s", d)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	size := int64(transform.HeaderSize() + transform.BlockSize())
+	if fi, _ := files[0].Stat(); fi.Size() != size {
+		t.Errorf("Wrong size after Sync: %d!=%d", fi.Size(), size)
+	}
+	if fi, _ := files[1].Stat(); fi.Size() != 0 {
+		t.Errorf("Journal not cleared: %d", fi.Size())
+	}
+	header, _ := transform.SyncHeader()
+	if d, _ := ioutil.ReadFile(files[0].Name()); !bytes.HasPrefix(d, header) {
+		t.Error("Header not written")
+	}
+	if err := bfile.Truncate(0); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if fi, _ := files[0].Stat(); fi.Size() != int64(transform.HeaderSize()) {
+		t.Errorf("Wrong size after Truncate: %d", fi.Size())
+	}
+}
+
+func TestJournalRecover(t *testing.T) {
+	files := tempFiles(t, 2)
+	if _, err := files[0].Write([]byte("old data, old data")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	record := encodeJournal(4, 12, []journalExtent{{off: 0, data: []byte("new")}, {off: 10, data: []byte("xy")}})
+	// Incomplete journal is rolled back
+	if _, err := files[1].WriteAt(record[:len(record)-1], 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if _, err := NewJournal(files[0], files[1]); err != nil {
+		t.Fatalf("NewJournal: %s", err)
+	}
+	if d, _ := ioutil.ReadFile(files[0].Name()); string(d) != "old data, old data" {
+		t.Errorf("Incomplete journal applied: %q", d)
+	}
+	// Complete journal is replayed
+	if _, err := files[1].WriteAt(record, 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	j, err := NewJournal(files[0], files[1])
+	if err != nil {
+		t.Fatalf("NewJournal: %s", err)
+	}
+	expect := "new \x00\x00\x00\x00\x00\x00xy"
+	if d, _ := ioutil.ReadFile(files[0].Name()); string(d) != expect {
+		t.Errorf("Journal not replayed: %q", d)
+	}
+	d := make([]byte, 20)
+	if n, _ := j.ReadAt(d, 0); string(d[:n]) != expect {
+		t.Errorf("False data: %q", d[:n])
+	}
+}
+
+// headerTransform returns a settable header.
+type headerTransform struct {
+	TestTransform
+	header []byte
+}
+
+func (ttf *headerTransform) Init(d []byte) error {
+	ttf.header = append([]byte(nil), d...)
+	return nil
+}
+
+func (ttf *headerTransform) SyncHeader() ([]byte, error) {
+	return append([]byte(nil), ttf.header...), nil
+}
+
+// TestJournalTruncate checks that Truncate commits header, blocks and size together.
+func TestJournalTruncate(t *testing.T) {
+	transform := &headerTransform{header: bytes.Repeat([]byte("A"), 48)}
+	files := tempFiles(t, 2)
+	bfile, err := NewJournaledBlockFile(files[0], files[1], transform)
+	if err != nil {
+		t.Fatalf("NewJournaledBlockFile: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := bfile.WriteBlock([]byte("old block")); err != nil {
+			t.Fatalf("WriteBlock: %s", err)
+		}
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	transform.header = bytes.Repeat([]byte("B"), 48)
+	if err := bfile.WriteBlockAt(0, []byte("new block")); err != nil {
+		t.Fatalf("WriteBlockAt: %s", err)
+	}
+	if err := bfile.Truncate(2); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	d, _ := ioutil.ReadFile(files[0].Name())
+	if size := transform.HeaderSize() + 2*transform.BlockSize(); len(d) != size {
+		t.Errorf("Wrong size after Truncate: %d!=%d", len(d), size)
+	} else if !bytes.Equal(d[:48], transform.header) {
+		t.Errorf("Header not committed: %q", d[:48])
+	}
+	if fi, _ := files[1].Stat(); fi.Size() != 0 {
+		t.Errorf("Journal not cleared: %d", fi.Size())
+	}
+	reopened := new(headerTransform)
+	rfile, err := NewJournaledBlockFile(files[0], files[1], reopened)
+	if err != nil {
+		t.Fatalf("NewJournaledBlockFile: %s", err)
+	}
+	if n, err := rfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 2 {
+		t.Errorf("NumBlocks: %d!=%d", n, 2)
+	}
+	if !bytes.Equal(reopened.header, transform.header) {
+		t.Errorf("False header: %q", reopened.header)
+	}
+	for i, expect := range []string{"new block", "old block"} {
+		if d, err := rfile.ReadBlockAt(int64(i), nil); err != nil {
+			t.Fatalf("ReadBlockAt: %s", err)
+		} else if !bytes.HasPrefix(d, []byte(expect)) {
+			t.Errorf("False data in block %d: %q", i, d)
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package fullfile
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sync"
+)
+
+const (
+	// logRecordSize is the size of the record header: tag, file size, batch, checksum and data length.
+	logRecordSize = 32
+	// logLastRecord is set in the data length of the last record of a batch.
+	logLastRecord = 1 << 31
+	// logHeaderTag tags records of the header.
+	logHeaderTag = math.MaxUint64
+	// logTruncateTag tags records that change the size of the file without data.
+	logTruncateTag = math.MaxUint64 - 1
+)
+
+var (
+	// ErrInvalidLog is returned when a LogFile is opened with a layout that does not fit its records, or when a record
+	// before the last complete batch of the log is damaged.
+	ErrInvalidLog = errors.New("invalid log record")
+
+	// errTornRecord is returned for records that are incomplete or damaged.
+	errTornRecord = errors.New("torn log record")
+
+	logTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// LogFile is a log-structured file that never overwrites data in place, for flash media and write-once storage.
+// The file consists of a header of headerSize bytes and blocks of blockSize bytes. Every write appends new versions
+// of the header or blocks to the log as one batch of records, tagged with the block number and the size of the file.
+// Each record names the start of its batch, and the last record of a batch is marked. An index of the latest version
+// of each block is rebuilt from the complete batches on open; everything after the last complete batch is a torn
+// append that is wiped and discarded, while damage before it is reported as ErrInvalidLog. Blocks never written are holes that read as zeros. To append each
+// block of a BlockFile as a whole, headerSize should be the header size and blockSize the block size of the layout
+// (its stride).
+//
+// Superseded versions stay in the log until Compact rewrites the live versions to a new log and wipes the old one.
+// LogFile is safe for concurrent use.
+type LogFile struct {
+	path       string
+	perm       os.FileMode
+	headerSize int64
+	blockSize  int64
+	rw         sync.RWMutex // held exclusively by writes.
+	f          *os.File
+	index      map[uint64]int64 // the position of the data of the latest version of each block.
+	end        int64            // the end of the log.
+	size       int64
+	closed     bool
+	mu         sync.Mutex // protects pos.
+	pos        int64
+}
+
+// OpenLogFile opens the log at path like os.OpenFile and rebuilds its index. An interrupted Compact is rolled back
+// or completed. O_APPEND is not supported.
+func OpenLogFile(path string, headerSize, blockSize int64, flag int, perm os.FileMode) (*LogFile, error) {
+	if headerSize < 0 || headerSize >= logLastRecord || blockSize <= 0 || blockSize >= logLastRecord ||
+		flag&os.O_APPEND != 0 {
+		return nil, os.ErrInvalid
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := cleanupReplace(path); err != nil {
+			return nil, err
+		}
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	l := &LogFile{
+		path:       path,
+		perm:       perm,
+		headerSize: headerSize,
+		blockSize:  blockSize,
+		f:          f,
+		index:      make(map[uint64]int64),
+	}
+	if err := l.rebuild(flag&os.O_RDWR != 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// unitSize returns the size of the data of records tagged tag.
+func (l *LogFile) unitSize(tag uint64) int64 {
+	switch tag {
+	case logHeaderTag:
+		return l.headerSize
+	case logTruncateTag:
+		return 0
+	}
+	return l.blockSize
+}
+
+// unit returns the tag of the header or block at offset off of the file, and the position of off in it.
+func (l *LogFile) unit(off int64) (tag uint64, pos int64) {
+	if off < l.headerSize {
+		return logHeaderTag, off
+	}
+	off -= l.headerSize
+	return uint64(off / l.blockSize), off % l.blockSize
+}
+
+// unitOffset returns the offset of the header or block tagged tag in the file.
+func (l *LogFile) unitOffset(tag uint64) int64 {
+	if tag == logHeaderTag {
+		return 0
+	}
+	return l.headerSize + int64(tag)*l.blockSize
+}
+
+// logRecord is a record read from the log.
+type logRecord struct {
+	tag   uint64
+	size  int64
+	batch int64 // the start of the batch.
+	pos   int64 // the position of the data.
+	last  bool  // the record ends its batch.
+}
+
+// rebuild reads the complete batches of the log to build the index. Everything after them is torn; if writable, it
+// is wiped and cut off. If a complete batch follows the damage, the log is damaged rather than torn and ErrInvalidLog
+// is returned, as it is if a record does not fit the layout.
+func (l *LogFile) rebuild(writable bool) error {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := fi.Size()
+	for l.end < fileSize {
+		records, end, err := l.readBatch(l.end, fileSize)
+		if err == errTornRecord {
+			break
+		} else if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if rec.tag != logTruncateTag {
+				l.index[rec.tag] = rec.pos
+			}
+			l.setSize(rec.size)
+		}
+		l.end = end
+	}
+	if l.end == fileSize {
+		return nil
+	}
+	if found, err := l.findBatch(l.end+1, fileSize); err != nil {
+		return err
+	} else if found {
+		return ErrInvalidLog
+	}
+	if writable {
+		if err := wipeRange(context.Background(), l.f, l.end, fileSize); err != nil {
+			return err
+		}
+		return l.f.Truncate(l.end)
+	}
+	return nil
+}
+
+// readBatch reads the records of the batch at start of a log of fileSize bytes and returns them and the end of the
+// batch. errTornRecord is returned if the batch is incomplete or damaged.
+func (l *LogFile) readBatch(start, fileSize int64) ([]logRecord, int64, error) {
+	var records []logRecord
+	for pos := start; ; {
+		rec, err := l.readRecord(pos, fileSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rec.batch != start {
+			return nil, 0, errTornRecord
+		}
+		records = append(records, rec)
+		pos = rec.pos + l.unitSize(rec.tag)
+		if rec.last {
+			return records, pos, nil
+		}
+	}
+}
+
+// findBatch returns true if a complete batch starts at or after off in a log of fileSize bytes. Only positions whose
+// record names them as the start of its batch are read as batches.
+func (l *LogFile) findBatch(off, fileSize int64) (bool, error) {
+	const window = 64 * 1024
+	buf := make([]byte, window+logRecordSize)
+	for w := off; w+logRecordSize <= fileSize; w += window {
+		n, err := l.f.ReadAt(buf, w)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		for i := 0; i < window && i+logRecordSize <= n; i++ {
+			q := w + int64(i)
+			if binary.BigEndian.Uint64(buf[i+16:i+24]) != uint64(q) {
+				continue
+			}
+			if _, _, err := l.readBatch(q, fileSize); err == nil {
+				return true, nil
+			} else if err != errTornRecord {
+				return false, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// readRecord reads the record at off of a log of fileSize bytes and checks it, without keeping its data.
+// errTornRecord is returned if it is incomplete or damaged, ErrInvalidLog if it is intact but does not fit the layout.
+func (l *LogFile) readRecord(off, fileSize int64) (logRecord, error) {
+	var rec logRecord
+	var head [logRecordSize]byte
+	if off+logRecordSize > fileSize {
+		return rec, errTornRecord
+	}
+	if _, err := l.f.ReadAt(head[:], off); err != nil {
+		return rec, err
+	}
+	rec.tag = binary.BigEndian.Uint64(head[0:8])
+	rec.size = int64(binary.BigEndian.Uint64(head[8:16]))
+	rec.batch = int64(binary.BigEndian.Uint64(head[16:24]))
+	length := binary.BigEndian.Uint32(head[28:32])
+	rec.last = length&logLastRecord != 0
+	rec.pos = off + logRecordSize
+	dataLen := int64(length &^ logLastRecord)
+	if rec.pos+dataLen > fileSize {
+		return rec, errTornRecord
+	}
+	c := crc32.New(logTable)
+	c.Write(head[0:24])
+	c.Write(head[28:32])
+	if _, err := io.Copy(c, io.NewSectionReader(l.f, rec.pos, dataLen)); err != nil {
+		return rec, err
+	}
+	if c.Sum32() != binary.BigEndian.Uint32(head[24:28]) || rec.size < 0 || rec.batch > off {
+		return rec, errTornRecord
+	}
+	if dataLen != l.unitSize(rec.tag) {
+		return rec, ErrInvalidLog
+	}
+	return rec, nil
+}
+
+// logChecksum returns the checksum of a record with header head and data d. The checksum field of head is skipped.
+func logChecksum(head, d []byte) uint32 {
+	c := crc32.Update(0, logTable, head[0:24])
+	c = crc32.Update(c, logTable, head[28:32])
+	return crc32.Update(c, logTable, d)
+}
+
+// appendRecord appends a record of the batch starting at batch to b. last marks the last record of the batch.
+func appendRecord(b []byte, tag uint64, size, batch int64, last bool, d []byte) []byte {
+	var head [logRecordSize]byte
+	binary.BigEndian.PutUint64(head[0:8], tag)
+	binary.BigEndian.PutUint64(head[8:16], uint64(size))
+	binary.BigEndian.PutUint64(head[16:24], uint64(batch))
+	length := uint32(len(d))
+	if last {
+		length |= logLastRecord
+	}
+	binary.BigEndian.PutUint32(head[28:32], length)
+	binary.BigEndian.PutUint32(head[24:28], logChecksum(head[:], d))
+	return append(append(b, head[:]...), d...)
+}
+
+// setSize sets the size of the file and drops the blocks past its end from the index. l.rw must be held
+// exclusively.
+func (l *LogFile) setSize(size int64) {
+	if size < l.size {
+		for tag := range l.index {
+			if l.unitOffset(tag) >= size {
+				delete(l.index, tag)
+			}
+		}
+	}
+	l.size = size
+}
+
+// readUnit reads the part of the header or block tagged tag at pos into p. l.rw must be held.
+func (l *LogFile) readUnit(p []byte, tag uint64, pos int64) error {
+	dataPos, ok := l.index[tag]
+	if !ok {
+		clear(p)
+		return nil
+	}
+	_, err := l.f.ReadAt(p, dataPos+pos)
+	return err
+}
+
+// ReadAt reads len(p) bytes at offset off. It implements io.ReaderAt.
+func (l *LogFile) ReadAt(p []byte, off int64) (int, error) {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= l.size {
+		return 0, io.EOF
+	}
+	n := int(min64(int64(len(p)), l.size-off))
+	for m := 0; m < n; {
+		tag, pos := l.unit(off + int64(m))
+		k := int(min64(int64(n-m), l.unitSize(tag)-pos))
+		if err := l.readUnit(p[m:m+k], tag, pos); err != nil {
+			return m, err
+		}
+		m += k
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off by appending new versions of the header and blocks it covers. It implements
+// io.WriterAt. Partially covered blocks are read and appended as a whole.
+func (l *LogFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+	size := max(l.size, off+int64(len(p)))
+	var units []logUnit
+	for m := 0; m < len(p); {
+		tag, pos := l.unit(off + int64(m))
+		u := make([]byte, l.unitSize(tag))
+		k := copy(u[pos:], p[m:])
+		if pos > 0 || k < len(u) {
+			tmp := make([]byte, len(u))
+			if err := l.readUnit(tmp, tag, 0); err != nil {
+				return 0, err
+			}
+			copy(tmp[pos:], p[m:m+k])
+			u = tmp
+		}
+		units = append(units, logUnit{tag, u})
+		m += k
+	}
+	if err := l.append(size, units); err != nil {
+		return 0, err
+	}
+	l.setSize(size)
+	return len(p), nil
+}
+
+// logUnit is a new version of the header or a block, or a truncation without data.
+type logUnit struct {
+	tag uint64
+	d   []byte
+}
+
+// append writes units to the end of the log as one batch of records for a file of size bytes, and indexes them.
+// l.rw must be held exclusively.
+func (l *LogFile) append(size int64, units []logUnit) error {
+	var b []byte
+	for i, u := range units {
+		b = appendRecord(b, u.tag, size, l.end, i == len(units)-1, u.d)
+	}
+	if _, err := l.f.WriteAt(b, l.end); err != nil {
+		return err
+	}
+	for _, u := range units {
+		if u.tag != logTruncateTag {
+			l.index[u.tag] = l.end + logRecordSize
+		}
+		l.end += logRecordSize + int64(len(u.d))
+	}
+	return nil
+}
+
+// Truncate changes the size of the file by appending a record. If the end of the file falls inside a block, a new
+// version of the block with the part past the end cleared is appended as well.
+func (l *LogFile) Truncate(size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	units := []logUnit{{tag: logTruncateTag}}
+	if tag, pos := l.unit(size); size < l.size && pos > 0 {
+		if _, ok := l.index[tag]; ok {
+			u := make([]byte, l.unitSize(tag))
+			if err := l.readUnit(u[:pos], tag, 0); err != nil {
+				return err
+			}
+			units = append(units, logUnit{tag, u})
+		}
+	}
+	if err := l.append(size, units); err != nil {
+		return err
+	}
+	l.setSize(size)
+	return nil
+}
+
+// Garbage returns the number of bytes of the log taken by superseded versions and truncation records, that Compact
+// would free.
+func (l *LogFile) Garbage() int64 {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+	live := int64(0)
+	for tag := range l.index {
+		live += logRecordSize + l.unitSize(tag)
+	}
+	return l.end - live
+}
+
+// Compact writes the latest versions of the header and blocks to a new log as one batch, which replaces the log
+// atomically. The old log, including all superseded versions, is wiped.
+func (l *LogFile) Compact() error {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	temp, err := createTemp(l.path, l.perm)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		wipeOpenFile(temp)
+		return err
+	}
+	tags := make([]uint64, 0, len(l.index))
+	for tag := range l.index {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	index := make(map[uint64]int64, len(tags))
+	end := int64(0)
+	var b []byte
+	for _, tag := range tags {
+		u := make([]byte, l.unitSize(tag))
+		if err := l.readUnit(u, tag, 0); err != nil {
+			return fail(err)
+		}
+		b = appendRecord(b[:0], tag, l.size, 0, false, u)
+		if _, err := temp.WriteAt(b, end); err != nil {
+			return fail(err)
+		}
+		index[tag] = end + logRecordSize
+		end += int64(len(b))
+	}
+	b = appendRecord(b[:0], logTruncateTag, l.size, 0, true, nil)
+	if _, err := temp.WriteAt(b, end); err != nil {
+		return fail(err)
+	}
+	end += int64(len(b))
+	err = replaceFile(l.path, temp)
+	if _, serr := os.Stat(temp.Name()); err != nil && !os.IsNotExist(serr) {
+		return fail(err)
+	}
+	// The new log is in place, even if wiping the old one failed.
+	l.f.Close()
+	l.f, l.index, l.end = temp, index, end
+	return err
+}
+
+// Read reads from the current position.
+func (l *LogFile) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.ReadAt(p, l.pos)
+	l.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current position.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.WriteAt(p, l.pos)
+	l.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the current position.
+func (l *LogFile) Seek(offset int64, whence int) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += l.pos
+	case io.SeekEnd:
+		l.rw.RLock()
+		offset += l.size
+		l.rw.RUnlock()
+	default:
+		return l.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return l.pos, os.ErrInvalid
+	}
+	l.pos = offset
+	return l.pos, nil
+}
+
+// Sync flushes the log to stable storage.
+func (l *LogFile) Sync() error {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	return l.f.Sync()
+}
+
+// Close closes the log.
+func (l *LogFile) Close() error {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	l.closed = true
+	return l.f.Close()
+}
@@ -0,0 +1,244 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.log")
+	transform := new(TestTransform)
+	open := func() *LogFile {
+		f, err := OpenLogFile(path, 48, 96, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatalf("OpenLogFile: %s", err)
+		}
+		return f
+	}
+	bfile, err := NewBlockFile(open(), transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := make([]byte, 32*10)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	// Overwrite a secret, which stays in the log until compaction
+	secret := bytes.Repeat([]byte("SECRET"), 5)
+	if _, err := sfile.WriteAt(secret, 64); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if _, err := sfile.WriteAt(d[64:64+len(secret)], 64); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := sfile.Truncate(32 * 8); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if raw, _ := os.ReadFile(path); !bytes.Contains(raw, secret) {
+		t.Error("Log overwritten in place")
+	}
+	// Torn record at the end
+	if f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	} else {
+		f.Write(appendRecord(nil, 3, 1000, 0, true, make([]byte, 96))[:50])
+		f.Close()
+	}
+	lfile := open()
+	if g := lfile.Garbage(); g == 0 {
+		t.Error("No garbage before Compact")
+	}
+	if err := lfile.Compact(); err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+	if g := lfile.Garbage(); g != logRecordSize {
+		t.Errorf("Garbage after Compact: %d!=%d", g, logRecordSize)
+	}
+	if raw, _ := os.ReadFile(path); bytes.Contains(raw, secret) {
+		t.Error("Secret not removed by Compact")
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Errorf("Stale files: %v", matches)
+	}
+	lfile.Close()
+	if bfile, err = NewBlockFile(open(), transform); err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	td := make([]byte, len(d))
+	if n, err := io.ReadFull(sfile, td); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read past end: %v", err)
+	} else if !bytes.Equal(td[:n], d[:32*8]) {
+		t.Errorf("False data:\n\t%x\n\t%x", d[:32*8], td[:n])
+	}
+}
+
+func TestLogFileDamage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.log")
+	lfile, err := OpenLogFile(path, 48, 96, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenLogFile: %s", err)
+	}
+	d := make([]byte, 48+96*3)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := lfile.WriteAt(d, 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if _, err := lfile.WriteAt(d[48:48+96], 48); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := lfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	// A different layout does not fit the records
+	if _, err := OpenLogFile(path, 48, 64, os.O_RDONLY, 0600); err != ErrInvalidLog {
+		t.Errorf("OpenLogFile with wrong layout: %v", err)
+	}
+	// Damage in the first batch is not a torn write, since the second batch is complete
+	damaged := bytes.Clone(raw)
+	damaged[logRecordSize+48+logRecordSize+10] ^= 1
+	if err := os.WriteFile(path, damaged, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	for _, flag := range []int{os.O_RDONLY, os.O_RDWR} {
+		if _, err := OpenLogFile(path, 48, 96, flag, 0600); err != ErrInvalidLog {
+			t.Errorf("OpenLogFile with damaged record: %v", err)
+		}
+	}
+	if d, _ := os.ReadFile(path); !bytes.Equal(d, damaged) {
+		t.Error("Damaged log changed")
+	}
+	// A damaged record at the end is torn and cut off
+	torn := appendRecord(bytes.Clone(raw), 1, 1000, int64(len(raw)), true, make([]byte, 96))
+	torn[len(torn)-1] ^= 1
+	if err := os.WriteFile(path, torn, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if lfile, err = OpenLogFile(path, 48, 96, os.O_RDWR, 0600); err != nil {
+		t.Fatalf("OpenLogFile: %s", err)
+	}
+	defer lfile.Close()
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf("Stat: %s", err)
+	} else if fi.Size() != int64(len(raw)) {
+		t.Errorf("Size after cutting torn record: %d!=%d", fi.Size(), len(raw))
+	}
+	td := make([]byte, len(d))
+	if _, err := lfile.ReadAt(td, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Error("False data")
+	}
+}
+
+func TestLogFileTornBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.log")
+	d := make([]byte, 48+96*8)
+	rand.New(rand.NewSource(1)).Read(d)
+	for _, first := range []bool{true, false} {
+		os.Remove(path)
+		lfile, err := OpenLogFile(path, 48, 96, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatalf("OpenLogFile: %s", err)
+		}
+		if !first {
+			if _, err := lfile.WriteAt(d[:48], 0); err != nil {
+				t.Fatalf("WriteAt: %s", err)
+			}
+		}
+		fi, err := lfile.f.Stat()
+		if err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		before := fi.Size()
+		// An append of 8 blocks, of which only the first half reached the disk
+		if _, err := lfile.WriteAt(d[48:], 48); err != nil {
+			t.Fatalf("WriteAt: %s", err)
+		}
+		if err := lfile.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		half := before + 4*(logRecordSize+96)
+		clear(raw[half:])
+		if err := os.WriteFile(path, raw, 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		if lfile, err = OpenLogFile(path, 48, 96, os.O_RDWR, 0600); err != nil {
+			t.Fatalf("OpenLogFile (first append %t): %s", first, err)
+		}
+		if fi, err := os.Stat(path); err != nil {
+			t.Fatalf("Stat: %s", err)
+		} else if fi.Size() != before {
+			t.Errorf("Size after cutting torn batch: %d!=%d", fi.Size(), before)
+		}
+		td := make([]byte, len(d))
+		n, _ := lfile.ReadAt(td, 0)
+		if first && n != 0 {
+			t.Errorf("Torn first append read: %d", n)
+		} else if !first && !bytes.Equal(td[:n], d[:48]) {
+			t.Errorf("False data: %d", n)
+		}
+		lfile.Close()
+	}
+}
+
+func TestLogFileInterruptedCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.log")
+	lfile, err := OpenLogFile(path, 48, 96, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenLogFile: %s", err)
+	}
+	d := make([]byte, 48+96*2)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := lfile.WriteAt(d, 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := lfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	// A crash during Compact between linking the log aside and renaming the new log over it leaves the link and the
+	// new log
+	if err := os.Link(path, path+atomicOldInfix+"123"); err != nil {
+		t.Skipf("Link: %s", err)
+	}
+	if err := os.WriteFile(path+atomicTempInfix+"456", []byte("compacted"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if lfile, err = OpenLogFile(path, 48, 96, os.O_RDWR, 0600); err != nil {
+		t.Fatalf("OpenLogFile: %s", err)
+	}
+	defer lfile.Close()
+	td := make([]byte, len(d))
+	if _, err := lfile.ReadAt(td, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Error("Log wiped by cleanup")
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Errorf("Stale files: %v", matches)
+	}
+}
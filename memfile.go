@@ -0,0 +1,281 @@
+package fullfile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+const memFileMinSize = 4096
+
+var (
+	// ErrInvalidSnapshot is returned when a snapshot cannot be decrypted, because it is damaged or the key is wrong.
+	ErrInvalidSnapshot = errors.New("invalid memory file snapshot")
+	// ErrMemFileTooLarge is returned when a MemFile would exceed the size of a buffer in memory.
+	ErrMemFileTooLarge = errors.New("memory file too large")
+
+	memSnapshotMagic = []byte("fullfile memory snapshot v1")
+)
+
+// MemFile is a file held in a SecureBuffer, so that neither the file nor the ciphertext of a BlockFile stored in it
+// ever reaches the disk. It can be serialised to an encrypted snapshot and restored with LoadMemFile. Its content is
+// destroyed by Close and zeroed by Panic.
+// MemFile is safe for concurrent use.
+type MemFile struct {
+	mu     sync.RWMutex
+	buf    *SecureBuffer // nil while empty.
+	size   int64
+	pos    int64
+	closed bool
+}
+
+// NewMemFile returns an empty MemFile.
+func NewMemFile() *MemFile {
+	return new(MemFile)
+}
+
+// LoadMemFile restores a MemFile from a snapshot written by Snapshot. Key must be the key given to Snapshot.
+func LoadMemFile(r io.Reader, key []byte) (*MemFile, error) {
+	aead, err := memSnapshotAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidSnapshot
+	}
+	f := NewMemFile()
+	size := len(d) - aead.NonceSize() - aead.Overhead()
+	if err := f.grow(int64(size)); err != nil {
+		return nil, err
+	}
+	var dst []byte
+	if f.buf != nil {
+		dst = f.buf.Bytes()[:0]
+	}
+	if _, err := aead.Open(dst, d[:aead.NonceSize()], d[aead.NonceSize():], memSnapshotMagic); err != nil {
+		f.Close()
+		return nil, ErrInvalidSnapshot
+	}
+	f.size = int64(size)
+	return f, nil
+}
+
+// memSnapshotAEAD returns AES-GCM with key, which must be 16, 24 or 32 bytes long.
+func memSnapshotAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Snapshot writes the content of the file to w, encrypted with AES-GCM under key, which must be 16, 24 or 32 bytes
+// long. The seek position is not part of the snapshot. A BlockFile stored in the MemFile must be synced before, and
+// closing it closes the MemFile.
+func (f *MemFile) Snapshot(w io.Writer, key []byte) error {
+	aead, err := memSnapshotAEAD(key)
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	d := make([]byte, aead.NonceSize(), aead.NonceSize()+int(f.size)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, d); err != nil {
+		return err
+	}
+	d = aead.Seal(d, d, f.data(), memSnapshotMagic)
+	_, err = w.Write(d)
+	return err
+}
+
+// data returns the content of the file. f.mu must be held.
+func (f *MemFile) data() []byte {
+	if f.buf == nil {
+		return nil
+	}
+	return f.buf.Bytes()[:f.size]
+}
+
+// grow makes room for size bytes, moving the content to a larger buffer if necessary. f.mu must be held exclusively.
+func (f *MemFile) grow(size int64) error {
+	if f.buf != nil && int64(f.buf.Len()) >= size {
+		return nil
+	}
+	if size > math.MaxInt {
+		return ErrMemFileTooLarge
+	}
+	c := int64(memFileMinSize)
+	if f.buf != nil {
+		c = int64(f.buf.Len())
+	}
+	for c < size {
+		if c > math.MaxInt/2 {
+			c = size
+			break
+		}
+		c *= 2
+	}
+	buf, err := NewSecureBuffer(int(c))
+	if err != nil {
+		return err
+	}
+	if f.buf != nil {
+		copy(buf.Bytes(), f.data())
+		f.buf.Destroy()
+	}
+	f.buf = buf
+	return nil
+}
+
+// readAt reads from off. f.mu must be held.
+func (f *MemFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data()[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// writeAt writes at off, extending the file if necessary. f.mu must be held exclusively.
+func (f *MemFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off > math.MaxInt64-int64(len(p)) {
+		return 0, ErrMemFileTooLarge
+	}
+	end := off + int64(len(p))
+	if err := f.grow(end); err != nil {
+		return 0, err
+	}
+	if end > f.size {
+		f.size = end
+	}
+	return copy(f.data()[off:], p), nil
+}
+
+// ReadAt reads len(p) bytes at offset off.
+func (f *MemFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.readAt(p, off)
+}
+
+// WriteAt writes p at offset off. Writing past the end fills the gap with zeros.
+func (f *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+// Read reads from the seek position.
+func (f *MemFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the seek position.
+func (f *MemFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the seek position. Seeking past the end is allowed.
+func (f *MemFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the file. Removed content is zeroed, extensions read as zeros.
+func (f *MemFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size < f.size {
+		clear(f.data()[size:])
+	} else if err := f.grow(size); err != nil {
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+// Len returns the size of the file.
+func (f *MemFile) Len() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.size
+}
+
+// Close destroys the content of the file.
+func (f *MemFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.buf != nil {
+		f.buf.Destroy()
+		f.buf = nil
+	}
+	f.closed, f.size, f.pos = true, 0, 0
+	return nil
+}
@@ -0,0 +1,103 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+)
+
+func memFiles(t *testing.T, n int) []*MemFile {
+	r := make([]*MemFile, n)
+	for i := range r {
+		f := NewMemFile()
+		t.Cleanup(func() { f.Close() })
+		r[i] = f
+	}
+	return r
+}
+
+func TestMemFile(t *testing.T) {
+	f := NewMemFile()
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("end"), 10000); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %s", err)
+	}
+	if _, err := f.Write([]byte("start")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	expect := make([]byte, 10003)
+	copy(expect, "start")
+	copy(expect[10000:], "end")
+	td := make([]byte, 10010)
+	if n, err := f.ReadAt(td, 0); err != io.EOF {
+		t.Errorf("ReadAt past end: %v", err)
+	} else if !bytes.Equal(td[:n], expect) {
+		t.Error("False data")
+	}
+	if err := f.Truncate(3); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if err := f.Truncate(8); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if n, _ := f.ReadAt(td, 0); !bytes.Equal(td[:n], []byte("sta\x00\x00\x00\x00\x00")) {
+		t.Errorf("False data after Truncate: %q", td[:n])
+	}
+	// Sizes near the limit fail instead of overflowing
+	if _, err := f.WriteAt([]byte("end"), math.MaxInt64-1); err != ErrMemFileTooLarge {
+		t.Errorf("WriteAt beyond limit: %v", err)
+	}
+	if err := f.Truncate(math.MaxInt64); err == nil {
+		t.Error("Truncate to limit succeeded")
+	}
+	if size := f.Len(); size != 8 {
+		t.Errorf("Size: %d!=%d", size, 8)
+	}
+}
+
+func TestMemFileSnapshot(t *testing.T) {
+	transform := new(TestTransform)
+	file := NewMemFile()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := bytes.Repeat([]byte("snapshot"), 20)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	snapshot := new(bytes.Buffer)
+	if err := file.Snapshot(snapshot, key); err != nil {
+		t.Fatalf("Snapshot: %s", err)
+	}
+	sfile.Close()
+	if bytes.Contains(snapshot.Bytes(), []byte("PREFIX")) {
+		t.Error("Snapshot not encrypted")
+	}
+	if _, err := LoadMemFile(bytes.NewReader(snapshot.Bytes()), make([]byte, 32)); err != ErrInvalidSnapshot {
+		t.Errorf("LoadMemFile with wrong key: %v", err)
+	}
+	if file, err = LoadMemFile(bytes.NewReader(snapshot.Bytes()), key); err != nil {
+		t.Fatalf("LoadMemFile: %s", err)
+	}
+	if bfile, err = NewBlockFile(file, transform); err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	td := make([]byte, len(d))
+	if _, err := io.ReadFull(sfile, td); err != nil {
+		t.Fatalf("Read: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Errorf("False data:\n\t%x\n\t%x", d, td)
+	}
+}
@@ -0,0 +1,283 @@
+package fullfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// mmapMinSize is the minimum size of a mapping. Mappings grow by doubling, so that extending a file sequentially
+// remaps it only rarely.
+const mmapMinSize = 1 << 20
+
+// MmapFile is a file accessed through a shared memory mapping, where supported (Linux). ReadAt and WriteAt copy
+// from and to the mapping without system calls, unless the mapping has to grow. The file on disk grows in the same
+// doubling steps as the mapping, and is trimmed to the size written by Sync and Close, so it may be larger until
+// then. Sync flushes the mapping with msync. The size of the file is only determined when it is opened, so it must
+// not be changed by other processes while it is open. MmapFile is safe for concurrent use.
+type MmapFile struct {
+	f        *os.File
+	writable bool
+	rw       sync.RWMutex // held exclusively while the mapping or the size change.
+	data     []byte       // the mapping, nil while empty.
+	size     int64        // the size of the data written.
+	fileSize int64        // the size of the file on disk, at least size.
+	closed   bool
+	mu       sync.Mutex // protects pos.
+	pos      int64
+}
+
+// OpenMmapFile opens the named file like os.OpenFile and maps it into memory. Files opened write-only are opened
+// for reading and writing, since mappings must be readable. O_APPEND is not supported.
+func OpenMmapFile(name string, flag int, perm os.FileMode) (*MmapFile, error) {
+	if !mmapSupported {
+		return nil, errors.ErrUnsupported
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, os.ErrInvalid
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &MmapFile{
+		f:        f,
+		writable: writable,
+		size:     fi.Size(),
+		fileSize: fi.Size(),
+	}
+	if err := r.remap(r.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// remap maps the file with room for at least size bytes. f.rw must be held exclusively.
+func (f *MmapFile) remap(size int64) error {
+	if size == 0 || size <= int64(len(f.data)) {
+		return nil
+	}
+	c := max(int64(mmapMinSize), 2*int64(len(f.data)))
+	for c < size {
+		c *= 2
+	}
+	if int64(int(c)) != c {
+		return os.ErrInvalid
+	}
+	data, err := mmap(f.f, int(c), f.writable)
+	if err != nil {
+		return err
+	}
+	if f.data != nil {
+		if err := munmap(f.data); err != nil {
+			munmap(data)
+			return err
+		}
+	}
+	f.data = data
+	return nil
+}
+
+// Len returns the size of the file.
+func (f *MmapFile) Len() int64 {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	return f.size
+}
+
+// ReadAt reads len(p) bytes at offset off. It implements io.ReaderAt.
+func (f *MmapFile) ReadAt(p []byte, off int64) (int, error) {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:f.size])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off. It implements io.WriterAt. Writing past the end extends the file and the mapping.
+func (f *MmapFile) WriteAt(p []byte, off int64) (int, error) {
+	if !f.writable {
+		return 0, ErrReadOnly
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	end := off + int64(len(p))
+	f.rw.RLock()
+	if f.closed {
+		f.rw.RUnlock()
+		return 0, os.ErrClosed
+	}
+	if end <= f.size {
+		defer f.rw.RUnlock()
+		return copy(f.data[off:], p), nil
+	}
+	f.rw.RUnlock()
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if end > f.size {
+		if err := f.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// truncate changes the size of the file. The file on disk is shrunk right away, so that discarded data does not
+// reappear when the file grows again. It is grown to the size of the mapping. f.rw must be held exclusively.
+func (f *MmapFile) truncate(size int64) error {
+	if size < f.size {
+		if err := f.f.Truncate(size); err != nil {
+			return err
+		}
+		f.fileSize = size
+	} else if size > f.fileSize {
+		if err := f.remap(size); err != nil {
+			return err
+		}
+		if err := f.f.Truncate(int64(len(f.data))); err != nil {
+			return err
+		}
+		f.fileSize = int64(len(f.data))
+	}
+	f.size = size
+	return nil
+}
+
+// trim shrinks the file on disk to the size written. f.rw must be held exclusively.
+func (f *MmapFile) trim() error {
+	if f.fileSize > f.size {
+		if err := f.f.Truncate(f.size); err != nil {
+			return err
+		}
+		f.fileSize = f.size
+	}
+	return nil
+}
+
+// Read reads from the current position.
+func (f *MmapFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current position.
+func (f *MmapFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the current position. It does not call the operating system.
+func (f *MmapFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.Len()
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+// Truncate changes the size of the file.
+func (f *MmapFile) Truncate(size int64) error {
+	if !f.writable {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.truncate(size)
+}
+
+// Sync trims the file and flushes the mapping and the file to stable storage.
+func (f *MmapFile) Sync() error {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.writable {
+		if err := f.trim(); err != nil {
+			return err
+		}
+	}
+	if f.writable && f.size > 0 {
+		if err := msync(f.data[:f.size]); err != nil {
+			return err
+		}
+	}
+	return f.f.Sync()
+}
+
+// Close trims, unmaps and closes the file. Changes are written back by the operating system, Sync must be called to
+// wait for stable storage.
+func (f *MmapFile) Close() error {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	var err error
+	if f.writable {
+		err = f.trim()
+	}
+	if f.data != nil {
+		if uerr := munmap(f.data); err == nil {
+			err = uerr
+		}
+		f.data = nil
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package fullfile
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmapSupported is true, since memory mapped files are supported on this platform.
+const mmapSupported = true
+
+// mmap maps size bytes of f, shared with the file.
+func mmap(f *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+// munmap removes a mapping created by mmap.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// msync writes the changes of data, which must start at a page boundary, back to the file and waits for completion.
+func msync(data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package fullfile
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapSupported is false, since memory mapped files are not supported on this platform.
+const mmapSupported = false
+
+// mmap is not supported on this platform.
+func mmap(f *os.File, size int, writable bool) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// munmap is not supported on this platform.
+func munmap(data []byte) error {
+	return errors.ErrUnsupported
+}
+
+// msync is not supported on this platform.
+func msync(data []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,120 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapFile(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap not supported")
+	}
+	path := filepath.Join(t.TempDir(), "vault")
+	transform := new(TestTransform)
+	bfile, err := OpenBlockFile(path, transform, &OpenOptions{Mmap: true})
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	// The file grows to three times the data, past the minimum mapping size
+	d := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	blocks := int64(len(d) / transform.DataSize())
+	size := int64(transform.HeaderSize()) + blocks*int64(transform.BlockSize())
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf("Stat: %s", err)
+	} else if fi.Size() != size {
+		t.Errorf("File size: %d!=%d", fi.Size(), size)
+	}
+	if err := sfile.Truncate(100); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if bfile, err = OpenBlockFile(path, transform, &OpenOptions{Mmap: true, ReadOnly: true}); err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	expect := append(d[:100:100], make([]byte, 28)...)
+	td := make([]byte, 200)
+	if n, err := io.ReadFull(sfile, td); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read past end: %v", err)
+	} else if !bytes.Equal(td[:n], expect) {
+		t.Errorf("False data:\n\t%x\n\t%x", expect, td[:n])
+	}
+	if _, err := OpenBlockFile(path, transform, &OpenOptions{Mmap: true, Direct: true}); err != os.ErrInvalid {
+		t.Errorf("OpenBlockFile with Direct: %v", err)
+	}
+}
+
+func TestMmapFileGrow(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap not supported")
+	}
+	path := filepath.Join(t.TempDir(), "vault")
+	f, err := OpenMmapFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenMmapFile: %s", err)
+	}
+	diskSize := func() int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		return fi.Size()
+	}
+	// The file grows with the mapping and is trimmed by Sync
+	if _, err := f.WriteAt([]byte("start"), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if _, err := f.WriteAt([]byte("end"), 100); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if size := diskSize(); size != mmapMinSize {
+		t.Errorf("Size on disk: %d!=%d", size, mmapMinSize)
+	}
+	if size := f.Len(); size != 103 {
+		t.Errorf("Size: %d!=%d", size, 103)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if size := diskSize(); size != 103 {
+		t.Errorf("Size on disk after Sync: %d!=%d", size, 103)
+	}
+	// Discarded data does not reappear
+	if err := f.Truncate(3); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 200); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	td := make([]byte, 201)
+	if _, err := f.ReadAt(td, 0); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	}
+	expect := make([]byte, 201)
+	copy(expect, "sta")
+	expect[200] = 'x'
+	if !bytes.Equal(td, expect) {
+		t.Errorf("False data: %q", td)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if size := diskSize(); size != 201 {
+		t.Errorf("Size on disk after Close: %d!=%d", size, 201)
+	}
+}
@@ -0,0 +1,176 @@
+package fullfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var (
+	// ErrInvalidObject is returned when the header object of an ObjectFile is malformed.
+	ErrInvalidObject = errors.New("invalid header object")
+)
+
+// ObjectFile is a file stored as objects of an ObjectStore. The header, the first headerSize bytes of the file, is
+// stored in the header object name/header, together with the size of the file and the versions of the data objects.
+// The rest of the file is split into data objects of objectSize bytes, named name/<index>.<version>, with a random
+// version for each commit, so that concurrent writers never overwrite each other's objects. Data objects
+// that were never written are holes that read as zeros. To map each group of blocks of a BlockFile to an object,
+// headerSize should be the header size and objectSize a multiple of the block size of the layout.
+//
+// Changes are kept in memory until Sync or Close commits them: changed data objects are uploaded under new names,
+// then the header object is replaced if its ETag did not change since it was read. If another writer committed
+// in between, ErrConflict is returned, the uploaded objects are removed, and the file must be opened again.
+// Superseded data objects are removed after a successful commit; those that cannot be removed are left behind as
+// orphans. Since they are removed right away, another ObjectFile that opened the file before the commit fails with an
+// error for which errors.Is(err, os.ErrNotExist) is true when it loads one of them, and has to be opened again.
+// ObjectFile is safe for concurrent use.
+type ObjectFile struct {
+	cachedFile
+	ctx      context.Context
+	store    ObjectStore
+	name     string
+	etag     string   // the ETag of the header object, empty if it does not exist.
+	versions []uint64 // the version of each data object, 0 for holes.
+	stale    []string // the keys of data objects to remove after the next commit.
+}
+
+// OpenObjectFile opens the file stored as objects of store below name, or an empty file if the header object does
+// not exist. ctx is used for all requests to store.
+func OpenObjectFile(ctx context.Context, store ObjectStore, name string, headerSize, objectSize int64) (*ObjectFile, error) {
+	if headerSize < 0 || objectSize <= 0 {
+		return nil, os.ErrInvalid
+	}
+	f := &ObjectFile{
+		ctx:   ctx,
+		store: store,
+		name:  name,
+	}
+	f.cachedFile = newCachedFile(f, headerSize, objectSize)
+	d, etag, err := store.Get(ctx, f.headerKey())
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := f.decodeHeader(d); err != nil {
+		return nil, err
+	}
+	f.etag = etag
+	return f, nil
+}
+
+// headerKey returns the key of the header object.
+func (f *ObjectFile) headerKey() string {
+	return f.name + "/header"
+}
+
+// objectKey returns the key of version v of data object n.
+func (f *ObjectFile) objectKey(n int64, v uint64) string {
+	return fmt.Sprintf("%s/%06d.%016x", f.name, n, v)
+}
+
+// encodeObjectHeader returns the content of the header object: size, header and the versions of the objects.
+func encodeObjectHeader(size int64, header []byte, versions []uint64) []byte {
+	d := make([]byte, 8, 8+len(header)+8*len(versions))
+	binary.BigEndian.PutUint64(d, uint64(size))
+	d = append(d, header...)
+	for _, v := range versions {
+		d = binary.BigEndian.AppendUint64(d, v)
+	}
+	return d
+}
+
+// decodeHeader sets size, header and the versions of the objects from the content of the header object.
+func (f *ObjectFile) decodeHeader(d []byte) error {
+	if len(d) < 8+len(f.header) {
+		return ErrInvalidObject
+	}
+	size := int64(binary.BigEndian.Uint64(d))
+	if size < 0 || int64(len(d)) != 8+f.headerSize+8*f.numObjects(size) {
+		return ErrInvalidObject
+	}
+	f.size = size
+	copy(f.header, d[8:])
+	f.versions = make([]uint64, f.numObjects(size))
+	for i := range f.versions {
+		f.versions[i] = binary.BigEndian.Uint64(d[8+len(f.header)+8*i:])
+	}
+	return nil
+}
+
+// load returns the content of data object n, or nil if it is a hole.
+func (f *ObjectFile) load(n int64) ([]byte, error) {
+	v := f.versions[n]
+	if v == 0 {
+		return nil, nil
+	}
+	d, _, err := f.store.Get(f.ctx, f.objectKey(n, v))
+	return d, err
+}
+
+// resize changes the number of data objects to num. Removed data objects are removed from the store after the next
+// commit.
+func (f *ObjectFile) resize(num int64) {
+	for n := num; n < int64(len(f.versions)); n++ {
+		if f.versions[n] != 0 {
+			f.stale = append(f.stale, f.objectKey(n, f.versions[n]))
+		}
+	}
+	if num < int64(len(f.versions)) {
+		f.versions = f.versions[:num]
+	}
+	for int64(len(f.versions)) < num {
+		f.versions = append(f.versions, 0)
+	}
+}
+
+// save uploads the changed data objects and replaces the header object.
+func (f *ObjectFile) save(size int64, header []byte, changed map[int64][]byte) error {
+	var gen uint64
+	for gen == 0 {
+		var r [8]byte
+		if _, err := rand.Read(r[:]); err != nil {
+			return err
+		}
+		gen = binary.BigEndian.Uint64(r[:])
+	}
+	versions := slices.Clone(f.versions)
+	var uploaded, superseded []string
+	for n, d := range changed {
+		key := f.objectKey(n, gen)
+		if _, err := f.store.Put(f.ctx, key, d); err != nil {
+			f.remove(uploaded)
+			return err
+		}
+		uploaded = append(uploaded, key)
+		if versions[n] != 0 {
+			superseded = append(superseded, f.objectKey(n, versions[n]))
+		}
+		versions[n] = gen
+	}
+	etag, err := f.store.PutIfMatch(f.ctx, f.headerKey(), encodeObjectHeader(size, header, versions), f.etag)
+	if err != nil {
+		f.remove(uploaded)
+		return err
+	}
+	f.etag, f.versions = etag, versions
+	// The commit succeeded, objects that cannot be removed are left as orphans
+	f.remove(append(f.stale, superseded...))
+	f.stale = nil
+	return nil
+}
+
+// remove deletes the objects keys, ignoring errors.
+func (f *ObjectFile) remove(keys []string) {
+	for _, key := range keys {
+		f.store.Delete(f.ctx, key)
+	}
+}
+
+// close does nothing, the store stays usable.
+func (f *ObjectFile) close() {}
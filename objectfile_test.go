@@ -0,0 +1,130 @@
+package fullfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestObjectFile(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemObjectStore()
+	server := httptest.NewServer(NewObjectStoreHandler(mem))
+	defer server.Close()
+	store := &HTTPObjectStore{URL: server.URL + "/bucket"}
+	transform := new(TestTransform)
+	// Four blocks per object
+	open := func() *ObjectFile {
+		f, err := OpenObjectFile(ctx, store, "vault", 48, 4*96)
+		if err != nil {
+			t.Fatalf("OpenObjectFile: %s", err)
+		}
+		return f
+	}
+	bfile, err := NewBlockFile(open(), transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := make([]byte, 32*20)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if keys := mem.Keys(); len(keys) != 6 {
+		t.Errorf("Objects: %d!=%d %v", len(keys), 6, keys)
+	}
+	// Concurrent writers
+	f1, f2 := open(), open()
+	if _, err := f1.WriteAt([]byte("first"), 100); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if _, err := f2.WriteAt([]byte("second"), 100); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := f1.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if err := f2.Sync(); err != ErrConflict {
+		t.Errorf("Sync of concurrent writer: %v", err)
+	}
+	if keys := mem.Keys(); len(keys) != 6 {
+		t.Errorf("Objects after conflict: %d!=%d %v", len(keys), 6, keys)
+	}
+	f2.Close()
+	if err := f1.Truncate(48 + 6*96); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if err := f1.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if keys := mem.Keys(); len(keys) != 3 {
+		t.Errorf("Objects after Truncate: %d!=%d %v", len(keys), 3, keys)
+	}
+	if bfile, err = NewBlockFile(open(), transform); err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	// Raw offset 100 is data byte 20 of block 0
+	expect := bytes.Clone(d[:32*6])
+	copy(expect[20:], "first")
+	td := make([]byte, len(d))
+	if n, err := io.ReadFull(sfile, td); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read past end: %v", err)
+	} else if !bytes.Equal(td[:n], expect) {
+		t.Errorf("False data:\n\t%x\n\t%x", expect, td[:n])
+	}
+}
+
+// deleteErrorStore fails to delete objects.
+type deleteErrorStore struct {
+	*MemObjectStore
+}
+
+func (s deleteErrorStore) Delete(ctx context.Context, key string) error {
+	return errors.New("delete failed")
+}
+
+func TestObjectFileOrphans(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemObjectStore()
+	f, err := OpenObjectFile(ctx, deleteErrorStore{mem}, "vault", 8, 16)
+	if err != nil {
+		t.Fatalf("OpenObjectFile: %s", err)
+	}
+	if _, err := f.WriteAt(make([]byte, 24), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	reader, err := OpenObjectFile(ctx, mem, "vault", 8, 16)
+	if err != nil {
+		t.Fatalf("OpenObjectFile: %s", err)
+	}
+	defer reader.Close()
+	// Superseded objects that cannot be deleted do not fail the commit
+	if _, err := f.WriteAt([]byte("changed"), 8); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if keys := mem.Keys(); len(keys) != 3 {
+		t.Errorf("Objects: %d!=%d %v", len(keys), 3, keys)
+	}
+	// Readers of the previous version fail once the superseded object is gone
+	mem.Delete(ctx, reader.objectKey(0, reader.versions[0]))
+	if _, err := reader.ReadAt(make([]byte, 8), 8); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadAt of superseded object: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package fullfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrConflict is returned when a conditional put fails, because the object has been changed by another writer.
+	ErrConflict = errors.New("object modified by another writer")
+)
+
+// ObjectStore is the minimal interface to S3-compatible object storage used by ObjectFile. Methods that read a
+// missing object return an error for which errors.Is(err, os.ErrNotExist) is true.
+type ObjectStore interface {
+	// Get returns the content and ETag of the object key.
+	Get(ctx context.Context, key string) ([]byte, string, error)
+	// Put stores data as object key and returns its ETag.
+	Put(ctx context.Context, key string, data []byte) (string, error)
+	// PutIfMatch stores data as object key if the ETag of the object equals etag, or, if etag is empty, if the object
+	// does not exist. It returns the new ETag, or ErrConflict if the condition fails.
+	PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error)
+	// Delete removes the object key. Removing a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// MemObjectStore is an ObjectStore in memory, for tests. It is safe for concurrent use.
+type MemObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemObjectStore returns an empty MemObjectStore.
+func NewMemObjectStore() *MemObjectStore {
+	return &MemObjectStore{objects: make(map[string][]byte)}
+}
+
+// objectETag returns the ETag of an object with content d.
+func objectETag(d []byte) string {
+	h := sha256.Sum256(d)
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", h[:16]))
+}
+
+// Get returns the content and ETag of the object key.
+func (s *MemObjectStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.objects[key]
+	if !ok {
+		return nil, "", &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return bytes.Clone(d), objectETag(d), nil
+}
+
+// Put stores data as object key and returns its ETag.
+func (s *MemObjectStore) Put(ctx context.Context, key string, data []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = bytes.Clone(data)
+	return objectETag(data), nil
+}
+
+// PutIfMatch stores data as object key if the ETag of the object equals etag, or, if etag is empty, if the object
+// does not exist.
+func (s *MemObjectStore) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.objects[key]
+	if ok != (etag != "") || (ok && objectETag(d) != etag) {
+		return "", ErrConflict
+	}
+	s.objects[key] = bytes.Clone(data)
+	return objectETag(data), nil
+}
+
+// Delete removes the object key.
+func (s *MemObjectStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// Keys returns the keys of all objects.
+func (s *MemObjectStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		r = append(r, k)
+	}
+	return r
+}
+
+// HTTPObjectStore is an ObjectStore that accesses objects below URL with plain GET, PUT and DELETE requests, using
+// the If-Match and If-None-Match headers for conditional puts, like S3-compatible storage with path-style URLs.
+// Requests are not signed; authentication must be provided by Client, for example through its Transport.
+type HTTPObjectStore struct {
+	URL    string       // the URL of the bucket.
+	Client *http.Client // the client for requests. If nil, http.DefaultClient is used.
+}
+
+// do sends a request for object key and returns the response body and ETag.
+func (s *HTTPObjectStore) do(ctx context.Context, method, key string, body []byte, header http.Header) ([]byte, string, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key), r)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	d, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return nil, "", ErrConflict
+	case resp.StatusCode/100 != 2:
+		return nil, "", fmt.Errorf("%s %s: %s", method, key, resp.Status)
+	}
+	return d, resp.Header.Get("ETag"), nil
+}
+
+// objectURL returns the URL of object key.
+func (s *HTTPObjectStore) objectURL(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.TrimSuffix(s.URL, "/") + "/" + strings.Join(parts, "/")
+}
+
+// Get returns the content and ETag of the object key.
+func (s *HTTPObjectStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	return s.do(ctx, http.MethodGet, key, nil, nil)
+}
+
+// Put stores data as object key and returns its ETag.
+func (s *HTTPObjectStore) Put(ctx context.Context, key string, data []byte) (string, error) {
+	_, etag, err := s.do(ctx, http.MethodPut, key, data, nil)
+	return etag, err
+}
+
+// PutIfMatch stores data as object key if the ETag of the object equals etag, or, if etag is empty, if the object
+// does not exist.
+func (s *HTTPObjectStore) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (string, error) {
+	header := http.Header{"If-Match": {etag}}
+	if etag == "" {
+		header = http.Header{"If-None-Match": {"*"}}
+	}
+	_, etag, err := s.do(ctx, http.MethodPut, key, data, header)
+	return etag, err
+}
+
+// Delete removes the object key.
+func (s *HTTPObjectStore) Delete(ctx context.Context, key string) error {
+	_, _, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// NewObjectStoreHandler returns an http.Handler that serves the objects of store to HTTPObjectStore. Together with
+// MemObjectStore and net/http/httptest, it is a local stand-in for S3-compatible storage in tests.
+func NewObjectStoreHandler(store ObjectStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		var d []byte
+		var etag string
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			d, etag, err = store.Get(r.Context(), key)
+		case http.MethodPut:
+			if d, err = io.ReadAll(r.Body); err != nil {
+				break
+			}
+			switch {
+			case r.Header.Get("If-None-Match") == "*":
+				etag, err = store.PutIfMatch(r.Context(), key, d, "")
+			case r.Header.Get("If-Match") != "":
+				etag, err = store.PutIfMatch(r.Context(), key, d, r.Header.Get("If-Match"))
+			default:
+				etag, err = store.Put(r.Context(), key, d)
+			}
+			d = nil
+		case http.MethodDelete:
+			err = store.Delete(r.Context(), key)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			http.Error(w, "not found", http.StatusNotFound)
+		case err == ErrConflict:
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			w.Write(d)
+		}
+	})
+}
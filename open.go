@@ -0,0 +1,116 @@
+package fullfile
+
+import (
+	"context"
+	"os"
+)
+
+// OpenOptions control how OpenBlockFile opens a file.
+type OpenOptions struct {
+	// Perm is used when the file is created. The default is 0600.
+	Perm os.FileMode
+	// Atomic makes all changes atomic by writing them to a temporary copy, that replaces the file on Sync and Close.
+	// See AtomicFile.
+	Atomic bool
+	// Lock coordinates access with other processes that open the file with Lock, through an advisory lock on the
+	// sidecar file path.lock that is held until the file is closed: shared if opened read-only, exclusive otherwise.
+	// If the lock is held by another BlockFile, ErrLocked is returned. See OpenBlockFileContext for waiting.
+	Lock bool
+	// ReadOnly opens an existing file read-only. See NewReadOnlyBlockFile. It cannot be combined with Atomic.
+	ReadOnly bool
+	// Align pads the header and rounds the blocks up to a multiple of Align bytes, unless the transform defines the
+	// layout. See Interlay. The same alignment must be used whenever the file is opened.
+	Align int64
+	// Direct opens the file for direct I/O, bypassing the page cache. See DirectFile. Align defaults to
+	// DirectAlignment. It cannot be combined with Atomic.
+	Direct bool
+	// Mmap accesses the file through a memory mapping. See MmapFile. It cannot be combined with Atomic or Direct.
+	Mmap bool
+	// ChunkSize stores the file in chunk files of ChunkSize bytes, path.000, path.001 and so on. See SplitFile. It
+	// cannot be combined with Atomic, Direct or Mmap.
+	ChunkSize int64
+}
+
+// OpenBlockFile opens the file at path as BlockFile, creating it if it does not exist and not opened read-only. opts
+// may be nil.
+func OpenBlockFile(path string, transform Transform, opts *OpenOptions) (*BlockFile, error) {
+	return OpenBlockFileContext(context.Background(), path, transform, opts)
+}
+
+// OpenBlockFileContext is like OpenBlockFile, but waits for a lock held by another BlockFile until ctx is done, and
+// aborts a full read requested by the transform when ctx is done.
+func OpenBlockFileContext(ctx context.Context, path string, transform Transform, opts *OpenOptions) (*BlockFile, error) {
+	var f ReadWriteCloseSeeker
+	var err error
+	if opts == nil {
+		opts = new(OpenOptions)
+	}
+	perm := opts.Perm
+	if perm == 0 {
+		perm = 0600
+	}
+	if opts.Atomic && (opts.ReadOnly || opts.Direct) {
+		return nil, os.ErrInvalid
+	}
+	if opts.Mmap && (opts.Atomic || opts.Direct) {
+		return nil, os.ErrInvalid
+	}
+	if opts.ChunkSize != 0 && (opts.Atomic || opts.Direct || opts.Mmap) {
+		return nil, os.ErrInvalid
+	}
+	cfg := blockFileConfig{
+		readOnly: opts.ReadOnly,
+		align:    opts.Align,
+	}
+	if opts.Direct && cfg.align == 0 {
+		cfg.align = DirectAlignment
+	}
+	if opts.Lock {
+		if cfg.flock, err = openFileLock(ctx, path, perm, opts.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	switch {
+	case opts.Atomic:
+		f, err = OpenAtomicFile(path, perm)
+	case opts.Direct:
+		var df *DirectFile
+		if df, err = OpenDirectFile(path, flag, perm); err == nil {
+			f = df
+		}
+	case opts.Mmap:
+		var mf *MmapFile
+		if mf, err = OpenMmapFile(path, flag, perm); err == nil {
+			f = mf
+		}
+	case opts.ChunkSize != 0:
+		var sf *SplitFile
+		if sf, err = OpenSplitFile(path, opts.ChunkSize, flag, perm); err == nil {
+			f = sf
+		}
+	default:
+		f, err = os.OpenFile(path, flag, perm)
+	}
+	if err == nil && opts.ReadOnly {
+		f = newReadOnlyFile(f)
+	}
+	if err != nil {
+		if cfg.flock != nil {
+			cfg.flock.close()
+		}
+		return nil, err
+	}
+	r, err := newBlockFile(ctx, f, transform, cfg)
+	if err != nil {
+		f.Close()
+		if cfg.flock != nil {
+			cfg.flock.close()
+		}
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,134 @@
+package fullfile
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrPanicked is returned by all operations after Panic has been called.
+	ErrPanicked = errors.New("distress panic: all handles destroyed")
+)
+
+// Destroyer can be implemented by a Transform that holds key material. Destroy must zero all secret state of the
+// Transform, for example by calling SecureBuffer.Destroy. It is called when the BlockFile is closed and on Panic.
+// It may be called more than once and concurrently with other methods of the Transform.
+type Destroyer interface {
+	Destroy()
+}
+
+// syncer is implemented by backends that can flush data to stable storage, like *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// committer is implemented by backends that keep changes in memory until Sync commits them as a whole, like Journal
+// and the object stores. Discarded data is wiped or removed by the commit, so BlockFile must not wipe or flush it
+// beforehand, which would commit the pending changes early.
+type committer interface {
+	commitsOnSync()
+}
+
+// contextSyncer is implemented by backends whose Sync can be aborted, like *Journal.
+type contextSyncer interface {
+	SyncContext(ctx context.Context) error
+}
+
+var (
+	panicked atomic.Bool
+	registry = struct {
+		sync.Mutex
+		files map[*BlockFile]struct{}
+	}{
+		files: make(map[*BlockFile]struct{}),
+	}
+)
+
+// register adds file to the registry of live handles.
+func register(file *BlockFile) error {
+	registry.Lock()
+	defer registry.Unlock()
+	if panicked.Load() {
+		return ErrPanicked
+	}
+	registry.files[file] = struct{}{}
+	return nil
+}
+
+// unregister removes file from the registry of live handles.
+func unregister(file *BlockFile) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.files, file)
+}
+
+// checkPanic returns ErrPanicked if Panic has been called.
+func checkPanic() error {
+	if panicked.Load() {
+		return ErrPanicked
+	}
+	return nil
+}
+
+// Panic destroys all open handles of the process. Transforms implementing Destroyer are destroyed, all live
+// SecureBuffers are zeroed and all underlying files are closed. If wipe is true, the headers (which carry the key
+// slots) are overwritten with random data before closing, which makes the files permanently unreadable. Files opened
+// read-only are not wiped.
+// After Panic, all operations on existing handles and all attempts to open new ones return ErrPanicked. Panic does not
+// wait for operations already in progress. It returns the first error encountered, but always processes all handles.
+func Panic(wipe bool) error {
+	var retErr error
+	registry.Lock()
+	defer registry.Unlock()
+	panicked.Store(true)
+	for file := range registry.files {
+		if err := file.destroy(wipe); err != nil && retErr == nil {
+			retErr = err
+		}
+		delete(registry.files, file)
+	}
+	zeroSecureBuffers()
+	return retErr
+}
+
+// destroy zeroes the transform of file, optionally wipes the header and closes the underlying file.
+func (file *BlockFile) destroy(wipe bool) error {
+	var retErr error
+	if d, ok := file.transform.(Destroyer); ok {
+		d.Destroy()
+	}
+	if wipe && !file.readOnly {
+		retErr = file.wipeHeader()
+	}
+	if err := file.data.Close(); err != nil && retErr == nil {
+		retErr = err
+	}
+	return retErr
+}
+
+// wipeHeader overwrites the header with random data and flushes it to stable storage, if supported. It is safe to
+// call while blocks are written.
+func (file *BlockFile) wipeHeader() error {
+	if file.headerSize == 0 {
+		return nil
+	}
+	r := make([]byte, file.headerSize)
+	if _, err := io.ReadFull(rand.Reader, r); err != nil {
+		return err
+	}
+	// Writes in flight seek under file.mu as well
+	file.mu.Lock()
+	_, err := writeFullAt(file.data, r, 0)
+	file.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s, ok := file.data.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+type destroyTransform struct {
+	TestTransform
+	destroyed bool
+}
+
+func (ttf *destroyTransform) Destroy() {
+	ttf.destroyed = true
+}
+
+// TestPanic runs in a child process since Panic is permanent for the process.
+func TestPanic(t *testing.T) {
+	if os.Getenv("FULLFILE_TEST_PANIC") == "1" {
+		testPanicChild(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPanic$", "-test.v")
+	cmd.Env = append(os.Environ(), "FULLFILE_TEST_PANIC=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Child: %s\n%s", err, out)
+	}
+}
+
+// seekFile is a file in plain memory that is only accessed through its seek position. Unlike a MemFile, it is not
+// zeroed by Panic.
+type seekFile struct {
+	mu  sync.Mutex
+	d   []byte
+	pos int64
+}
+
+func (f *seekFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pos >= int64(len(f.d)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *seekFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := f.pos + int64(len(p)); end > int64(len(f.d)) {
+		f.d = append(f.d, make([]byte, end-int64(len(f.d)))...)
+	}
+	copy(f.d[f.pos:], p)
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *seekFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.d))
+	}
+	f.pos = offset
+	f.mu.Unlock()
+	// Let other goroutines seek before the following Write
+	runtime.Gosched()
+	return offset, nil
+}
+
+func (f *seekFile) Close() error { return nil }
+
+// TestPanicConcurrent wipes the header of a file that is written through its seek position by other goroutines.
+func TestPanicConcurrent(t *testing.T) {
+	if os.Getenv("FULLFILE_TEST_PANIC") == "2" {
+		testPanicConcurrentChild(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPanicConcurrent$", "-test.v")
+	cmd.Env = append(os.Environ(), "FULLFILE_TEST_PANIC=2")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Child: %s\n%s", err, out)
+	}
+}
+
+func testPanicConcurrentChild(t *testing.T) {
+	transform := new(TestTransform)
+	sfile := new(seekFile)
+	bfile, err := NewBlockFile(sfile, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	var wg sync.WaitGroup
+	started := make(chan struct{}, 4)
+	for i := int64(0); i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				if j == 10 {
+					started <- struct{}{}
+				}
+				if err := bfile.WriteBlockAt(i, []byte("Test Block 001")); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+	if err := Panic(true); err != nil {
+		t.Fatalf("Panic: %s", err)
+	}
+	wg.Wait()
+	header, _ := transform.SyncHeader()
+	if bytes.HasPrefix(sfile.d, header) {
+		t.Error("Header not wiped")
+	}
+	expect, _ := transform.WriteBlock(0, []byte("Test Block 001"))
+	for i := int64(0); i < 4; i++ {
+		pos := int64(len(header)) + i*int64(transform.BlockSize())
+		if block := sfile.d[pos : pos+int64(len(expect))]; !bytes.Equal(block, expect) {
+			t.Errorf("Block %d overwritten by wipe", i)
+		}
+	}
+}
+
+func testPanicChild(t *testing.T) {
+	transform := new(destroyTransform)
+	file, err := ioutil.TempFile("", "testpanic.")
+	if err != nil {
+		t.Fatalf("TempFile: %s", err)
+	}
+	defer os.Remove(file.Name())
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	if err := bfile.WriteBlock([]byte("Test Block 001")); err != nil {
+		t.Fatalf("WriteBlock: %s", err)
+	}
+	if err := bfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if err := Panic(true); err != nil {
+		t.Fatalf("Panic: %s", err)
+	}
+	if !transform.destroyed {
+		t.Error("Transform not destroyed")
+	}
+	if _, err := bfile.ReadBlock(nil); err != ErrPanicked {
+		t.Errorf("ReadBlock after panic: %v", err)
+	}
+	if err := bfile.WriteBlock([]byte("Test Block 002")); err != ErrPanicked {
+		t.Errorf("WriteBlock after panic: %v", err)
+	}
+	if err := bfile.Close(); err != ErrPanicked {
+		t.Errorf("Close after panic: %v", err)
+	}
+	if _, err := NewBlockFile(file, transform); err != ErrPanicked {
+		t.Errorf("NewBlockFile after panic: %v", err)
+	}
+	d, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	header, _ := transform.SyncHeader()
+	if bytes.HasPrefix(d, header) {
+		t.Error("Header not wiped")
+	}
+}
+
+type syncErrorTransform struct {
+	TestTransform
+	err error
+}
+
+func (ttf *syncErrorTransform) SyncHeader() ([]byte, error) {
+	if ttf.err != nil {
+		return nil, ttf.err
+	}
+	return ttf.TestTransform.SyncHeader()
+}
+
+func TestCloseError(t *testing.T) {
+	transform := &syncErrorTransform{err: os.ErrInvalid}
+	bfile, err := NewBlockFile(NewMemFile(), transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	registered := func() bool {
+		registry.Lock()
+		defer registry.Unlock()
+		_, ok := registry.files[bfile]
+		return ok
+	}
+	if err := bfile.Close(); err != os.ErrInvalid {
+		t.Errorf("Close with failing sync: %v", err)
+	}
+	if !registered() {
+		t.Error("File unregistered after failed close")
+	}
+	transform.err = nil
+	if err := bfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if registered() {
+		t.Error("File registered after close")
+	}
+}
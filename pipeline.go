@@ -0,0 +1,346 @@
+package fullfile
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// pipelineJob is a block processed by a pipeline.
+type pipelineJob struct {
+	block int64
+	buf   *SecureBuffer // holds plaintext, if any. It belongs to pool.
+	pool  *securePool
+	in    []byte
+	out   []byte
+	err   error
+	done  chan struct{}
+}
+
+// release returns the buffer of the job to its pool.
+func (j *pipelineJob) release() {
+	if j.buf != nil {
+		j.pool.put(j.buf)
+		j.buf = nil
+	}
+}
+
+// securePool keeps zeroed SecureBuffers of size bytes for reuse, so that a pipeline does not map and lock memory for
+// every block. It is safe for concurrent use.
+type securePool struct {
+	mu   sync.Mutex
+	size int
+	free []*SecureBuffer
+}
+
+// get returns a zeroed buffer from the pool, or allocates one.
+func (p *securePool) get() (*SecureBuffer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.free); n > 0 {
+		buf := p.free[n-1]
+		p.free = p.free[:n-1]
+		return buf, nil
+	}
+	return NewSecureBuffer(p.size)
+}
+
+// put zeroes buf and returns it to the pool.
+func (p *securePool) put(buf *SecureBuffer) {
+	clear(buf.Bytes())
+	p.mu.Lock()
+	p.free = append(p.free, buf)
+	p.mu.Unlock()
+}
+
+// destroy destroys all buffers in the pool.
+func (p *securePool) destroy() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, buf := range p.free {
+		buf.Destroy()
+	}
+	p.free = nil
+}
+
+// pipeline processes jobs with a pool of GOMAXPROCS workers and consumes the results in the order they were produced.
+// produce returns the next job, or nil at the end. process is called concurrently by the workers and reports errors
+// in the job. consume is called for each job in order. The first error stops the pipeline and is returned. Once ctx
+// is done, no further jobs are produced and the error of ctx is returned. All jobs are released.
+func pipeline(ctx context.Context, produce func() (*pipelineJob, error), process func(*pipelineJob), consume func(*pipelineJob) error) error {
+	var produceErr error
+	workers := runtime.GOMAXPROCS(0)
+	jobs := make(chan *pipelineJob)
+	order := make(chan *pipelineJob, 2*workers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				process(j)
+				close(j.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := ctx.Err(); err != nil {
+				produceErr = err
+				return
+			}
+			j, err := produce()
+			if err != nil || j == nil {
+				produceErr = err
+				return
+			}
+			j.done = make(chan struct{})
+			select {
+			case order <- j:
+			case <-stop:
+				j.release()
+				return
+			}
+			jobs <- j
+		}
+	}()
+	var err error
+	for j := range order {
+		<-j.done
+		if err == nil {
+			if err = j.err; err == nil {
+				err = consume(j)
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+		j.release()
+	}
+	wg.Wait()
+	if err == nil {
+		err = produceErr
+	}
+	return err
+}
+
+// writeRaw writes the transformed block n. The caller must hold the file lock for writing.
+func (file *BlockFile) writeRaw(n int64, d []byte) error {
+	l := file.blockLock(n)
+	l.Lock()
+	defer l.Unlock()
+	return file.writeAt(d, n)
+}
+
+// writeBlocksFrom reads full blocks from r and writes them from block start on. Blocks are transformed in parallel
+// and written in order. A trailing partial block is returned in a SecureBuffer, along with its length, and has to be
+// written by the caller.
+func (file *BlockFile) writeBlocksFrom(ctx context.Context, start int64, r io.Reader) (blocks int64, tail *SecureBuffer, tailLen int, err error) {
+	if err := checkPanic(); err != nil {
+		return 0, nil, 0, err
+	}
+	if file.readOnly {
+		return 0, nil, 0, ErrReadOnly
+	}
+	file.rw.RLock()
+	defer file.rw.RUnlock()
+	next := start
+	pool := &securePool{size: file.dataSize}
+	defer pool.destroy()
+	produce := func() (*pipelineJob, error) {
+		if tail != nil {
+			return nil, nil
+		}
+		buf, err := pool.get()
+		if err != nil {
+			return nil, err
+		}
+		m, err := io.ReadFull(r, buf.Bytes())
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if m > 0 {
+				tail, tailLen = buf, m
+			} else {
+				pool.put(buf)
+			}
+			return nil, nil
+		} else if err != nil {
+			pool.put(buf)
+			return nil, err
+		}
+		j := &pipelineJob{block: next, buf: buf, pool: pool, in: buf.Bytes()}
+		next++
+		return j, nil
+	}
+	process := func(j *pipelineJob) {
+		j.out, j.err = file.transform.WriteBlock(j.block, j.in)
+	}
+	consume := func(j *pipelineJob) error {
+		if err := file.writeRaw(j.block, j.out); err != nil {
+			return err
+		}
+		blocks++
+		return nil
+	}
+	err = pipeline(ctx, produce, process, consume)
+	if err != nil && tail != nil {
+		tail.Destroy()
+		tail, tailLen = nil, 0
+	}
+	return blocks, tail, tailLen, err
+}
+
+// readBlocksTo reads blocks from start on in parallel and writes the first n bytes of their data to w in order.
+func (file *BlockFile) readBlocksTo(ctx context.Context, start, n int64, w io.Writer) (int64, error) {
+	var written int64
+	next := start
+	end := start + (n+int64(file.dataSize)-1)/int64(file.dataSize)
+	pool := &securePool{size: file.blockSize}
+	defer pool.destroy()
+	produce := func() (*pipelineJob, error) {
+		if next >= end {
+			return nil, nil
+		}
+		buf, err := pool.get()
+		if err != nil {
+			return nil, err
+		}
+		j := &pipelineJob{block: next, buf: buf, pool: pool, in: buf.Bytes()}
+		next++
+		return j, nil
+	}
+	process := func(j *pipelineJob) {
+		j.out, j.err = file.ReadBlockAt(j.block, j.in)
+	}
+	consume := func(j *pipelineJob) error {
+		m, err := w.Write(j.out[:min64(int64(len(j.out)), n-written)])
+		written += int64(m)
+		return err
+	}
+	return written, pipeline(ctx, produce, process, consume)
+}
+
+// ReadFrom writes the data read from r until EOF to the file at the current position, and advances the position.
+// Full blocks are encrypted in parallel by GOMAXPROCS workers and written in order. It implements io.ReaderFrom.
+func (file *StreamFile) ReadFrom(r io.Reader) (n int64, err error) {
+	return file.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is like ReadFrom, but stops between blocks when ctx is done. The blocks written until then remain
+// and are included in n.
+func (file *StreamFile) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	file.mu.Lock()
+	pos := file.pos
+	file.mu.Unlock()
+	if offset := pos % file.datasize; offset != 0 {
+		m, err := io.CopyN(io.NewOffsetWriter(file, pos), r, file.datasize-offset)
+		n += m
+		pos += m
+		if err != nil {
+			file.setPos(pos)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+	}
+	m, err := file.writeBlocksFrom(ctx, pos/file.datasize, r)
+	n += m
+	file.setPos(pos + m)
+	return n, err
+}
+
+// writeBlocksFrom writes full blocks read from r from block start on, bypassing the cache, followed by a trailing
+// partial block.
+func (file *StreamFile) writeBlocksFrom(ctx context.Context, start int64, r io.Reader) (int64, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if err := file.flush(); err != nil {
+		return 0, err
+	}
+	if _, err := file.numBlocks(); err != nil {
+		return 0, err
+	}
+	for _, entry := range file.cache.all() {
+		if entry.block >= start {
+			file.cache.remove(entry).Destroy()
+		}
+	}
+	file.written++
+	blocks, tail, tailLen, err := file.file.writeBlocksFrom(ctx, start, r)
+	n := blocks * file.datasize
+	if end := start + blocks; end > file.end {
+		file.end = end
+	}
+	file.extend(start*file.datasize + n)
+	if err != nil {
+		return n, err
+	}
+	if tail != nil {
+		defer tail.Destroy()
+		m, err := file.patch(tail.Bytes()[:tailLen], start*file.datasize+n)
+		return n + int64(m), err
+	}
+	return n, nil
+}
+
+// WriteTo writes the data of the file from the current position to its end to w, and advances the position.
+// Blocks are decrypted in parallel by GOMAXPROCS workers and written to w in order. It implements io.WriterTo.
+func (file *StreamFile) WriteTo(w io.Writer) (n int64, err error) {
+	return file.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is like WriteTo, but stops between blocks when ctx is done.
+func (file *StreamFile) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
+	var size int64
+	file.mu.Lock()
+	pos := file.pos
+	if err = file.flush(); err == nil {
+		_, err = file.numBlocks()
+		size = file.size
+	}
+	file.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if offset := pos % file.datasize; offset != 0 && pos < size {
+		d := make([]byte, file.datasize-offset)
+		m, err := file.ReadAt(d, pos)
+		if err == nil || err == io.EOF {
+			m, err = w.Write(d[:m])
+		}
+		clear(d)
+		n += int64(m)
+		if err != nil {
+			file.setPos(pos + n)
+			return n, err
+		}
+	}
+	start := (pos + n) / file.datasize
+	if pos+n < size {
+		m, err := file.file.readBlocksTo(ctx, start, size-pos-n, w)
+		n += m
+		if err != nil {
+			file.setPos(pos + n)
+			return n, err
+		}
+	}
+	file.setPos(pos + n)
+	return n, nil
+}
+
+// setPos sets the current position.
+func (file *StreamFile) setPos(pos int64) {
+	file.mu.Lock()
+	file.pos = pos
+	file.block = pos / file.datasize
+	file.mu.Unlock()
+}
@@ -0,0 +1,180 @@
+package fullfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// aesTransform encrypts blocks with AES-GCM, using the block number as nonce. It is only suitable for testing.
+type aesTransform struct {
+	aead cipher.AEAD
+}
+
+func newAESTransform() *aesTransform {
+	block, _ := aes.NewCipher(make([]byte, 32))
+	aead, _ := cipher.NewGCM(block)
+	return &aesTransform{aead: aead}
+}
+
+func (ttf *aesTransform) HeaderSize() int             { return 0 }
+func (ttf *aesTransform) BlockSize() int              { return 4096 + ttf.aead.Overhead() }
+func (ttf *aesTransform) DataSize() int               { return 4096 }
+func (ttf *aesTransform) Init(d []byte) error         { return nil }
+func (ttf *aesTransform) SyncHeader() ([]byte, error) { return nil, nil }
+
+func (ttf *aesTransform) FullRead(r io.Reader) ([]byte, error) {
+	return nil, nil
+}
+
+func (ttf *aesTransform) nonce(n int64) []byte {
+	nonce := make([]byte, ttf.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(n))
+	return nonce
+}
+
+func (ttf *aesTransform) ReadBlock(n int64, block []byte) ([]byte, error) {
+	return ttf.aead.Open(block[:0], ttf.nonce(n), block[:ttf.BlockSize()], nil)
+}
+
+func (ttf *aesTransform) ReadBlockTo(n int64, dst, block []byte) ([]byte, error) {
+	return ttf.aead.Open(dst[:0], ttf.nonce(n), block[:ttf.BlockSize()], nil)
+}
+
+func (ttf *aesTransform) WriteBlock(n int64, data []byte) ([]byte, error) {
+	return ttf.aead.Seal(nil, ttf.nonce(n), data, nil), nil
+}
+
+func (ttf *aesTransform) WriteBlockTo(n int64, dst, data []byte) ([]byte, error) {
+	return ttf.aead.Seal(dst[:0], ttf.nonce(n), data, nil), nil
+}
+
+func TestStreamFilePipeline(t *testing.T) {
+	transform := new(TestTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := make([]byte, 32*100+7)
+	rand.New(rand.NewSource(1)).Read(d)
+	// Unaligned start, trailing partial block
+	if _, err := sfile.WriteAt([]byte("cached"), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	sfile.Seek(5, io.SeekStart)
+	if n, err := sfile.ReadFrom(bytes.NewReader(d)); err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	} else if n != int64(len(d)) {
+		t.Errorf("ReadFrom length: %d!=%d", n, len(d))
+	}
+	if pos, _ := sfile.Seek(0, io.SeekCurrent); pos != int64(5+len(d)) {
+		t.Errorf("Wrong position: %d!=%d", pos, 5+len(d))
+	}
+	expect := append([]byte("cache"), d...)
+	expect = append(expect, make([]byte, 32-(len(expect)%32))...)
+	sfile.Seek(0, io.SeekStart)
+	var b bytes.Buffer
+	if n, err := sfile.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	} else if n != int64(len(expect)) {
+		t.Errorf("WriteTo length: %d!=%d", n, len(expect))
+	}
+	if !bytes.Equal(b.Bytes(), expect) {
+		t.Errorf("False data:\n\t%x\n\t%x", expect, b.Bytes())
+	}
+	// Unaligned read
+	sfile.Seek(40, io.SeekStart)
+	b.Reset()
+	if _, err := sfile.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	} else if !bytes.Equal(b.Bytes(), expect[40:]) {
+		t.Errorf("False data unaligned")
+	}
+}
+
+func benchmarkFile(b *testing.B) *StreamFile {
+	file, err := ioutil.TempFile(b.TempDir(), "benchmark.")
+	if err != nil {
+		b.Fatalf("TempFile: %s", err)
+	}
+	bfile, err := NewBlockFile(file, newAESTransform())
+	if err != nil {
+		b.Fatalf("NewBlockFile: %s", err)
+	}
+	return NewStreamFile(bfile)
+}
+
+const benchmarkSize = 16 << 20
+
+func BenchmarkStreamFileReadFrom(b *testing.B) {
+	sfile := benchmarkFile(b)
+	defer sfile.Close()
+	d := make([]byte, benchmarkSize)
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sfile.Seek(0, io.SeekStart)
+		if _, err := sfile.ReadFrom(bytes.NewReader(d)); err != nil {
+			b.Fatalf("ReadFrom: %s", err)
+		}
+	}
+}
+
+func BenchmarkStreamFileWriteTo(b *testing.B) {
+	sfile := benchmarkFile(b)
+	defer sfile.Close()
+	if _, err := sfile.ReadFrom(bytes.NewReader(make([]byte, benchmarkSize))); err != nil {
+		b.Fatalf("ReadFrom: %s", err)
+	}
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sfile.Seek(0, io.SeekStart)
+		if _, err := sfile.WriteTo(ioutil.Discard); err != nil {
+			b.Fatalf("WriteTo: %s", err)
+		}
+	}
+}
+
+func TestStreamFilePipelineContext(t *testing.T) {
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], new(TestTransform))
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := make([]byte, 32*100)
+	rand.New(rand.NewSource(1)).Read(d)
+	n, err := sfile.ReadFromContext(newCountdownContext(10), bytes.NewReader(d))
+	if err != context.Canceled {
+		t.Errorf("ReadFromContext cancelled: %v", err)
+	}
+	if n != 32*10 {
+		t.Errorf("ReadFromContext length: %d!=%d", n, 32*10)
+	}
+	if _, err := sfile.ReadFrom(bytes.NewReader(d[n:])); err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	sfile.Seek(0, io.SeekStart)
+	var b bytes.Buffer
+	if n, err := sfile.WriteToContext(newCountdownContext(5), &b); err != context.Canceled {
+		t.Errorf("WriteToContext cancelled: %v", err)
+	} else if n != 32*5 || !bytes.Equal(b.Bytes(), d[:n]) {
+		t.Errorf("False data after cancellation: %d bytes", n)
+	}
+	b.Reset()
+	sfile.Seek(0, io.SeekStart)
+	if _, err := sfile.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	} else if !bytes.Equal(b.Bytes(), d) {
+		t.Errorf("False data")
+	}
+}
@@ -0,0 +1,169 @@
+package fullfile
+
+import (
+	"sync"
+)
+
+// DefaultReadAhead is the maximum number of blocks a StreamFile prefetches by default on sequential reads.
+const DefaultReadAhead = 8
+
+// prefetch is a block that is read in the background.
+type prefetch struct {
+	buf     *SecureBuffer // holds the decrypted block.
+	data    []byte        // the data of the block, within buf.
+	err     error
+	written int64         // the write counter of the StreamFile when the read started.
+	dropped bool          // the prefetch is not needed anymore, buf is destroyed on completion.
+	done    chan struct{} // closed on completion.
+}
+
+// readAhead detects sequential reads and keeps track of prefetched blocks. The depth starts at one block and doubles
+// with every sequential block read, up to max.
+type readAhead struct {
+	max     int                 // the maximum depth. 0 disables read-ahead.
+	depth   int                 // the current depth.
+	next    int64               // the block expected to be read next by a sequential reader.
+	pending map[int64]*prefetch // prefetched blocks.
+	wg      sync.WaitGroup      // running prefetches.
+}
+
+// SetReadAhead sets the maximum number of blocks to prefetch when reading sequentially. 0 disables read-ahead.
+func (file *StreamFile) SetReadAhead(blocks int) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if blocks < 0 {
+		blocks = 0
+	}
+	file.ahead.max = blocks
+	if file.ahead.depth > blocks {
+		file.ahead.depth = blocks
+	}
+}
+
+// readAhead is called before reading block with the seek position. If reads are sequential, it prefetches the
+// following blocks. The caller must hold the lock.
+func (file *StreamFile) readAhead(block int64) error {
+	switch {
+	case block == file.ahead.next:
+		file.ahead.depth = min(max(2*file.ahead.depth, 1), file.ahead.max)
+	case block == file.ahead.next-1:
+		// Still reading the same block.
+	default:
+		file.dropReadAhead()
+	}
+	file.ahead.next = block + 1
+	for b, pf := range file.ahead.pending {
+		if b < block {
+			file.dropPrefetch(b, pf)
+		}
+	}
+	if file.ahead.depth == 0 {
+		return nil
+	}
+	stored, err := file.file.NumBlocks()
+	if err != nil {
+		return err
+	}
+	var start, count int64
+	for b := block + 1; b <= block+int64(file.ahead.depth) && b < stored; b++ {
+		if _, ok := file.ahead.pending[b]; !ok && file.cache.peek(b) == nil {
+			if count == 0 {
+				start = b
+			}
+			count++
+			continue
+		}
+		if count > 0 {
+			file.prefetch(start, count)
+			count = 0
+		}
+	}
+	if count > 0 {
+		file.prefetch(start, count)
+	}
+	return nil
+}
+
+// prefetch starts reading count blocks from start on in the background, with a single read of the BlockFile. The
+// blocks are decrypted straight into the buffers of the prefetches. The caller must hold the lock.
+func (file *StreamFile) prefetch(start, count int64) {
+	pfs := make([]*prefetch, count)
+	dsts := make([][]byte, count)
+	for i := range pfs {
+		buf, err := file.getBuffer()
+		if err != nil {
+			for _, pf := range pfs[:i] {
+				file.putBuffer(pf.buf)
+			}
+			return
+		}
+		pfs[i] = &prefetch{
+			buf:     buf,
+			written: file.written,
+			done:    make(chan struct{}),
+		}
+		dsts[i] = buf.Bytes()
+	}
+	if file.ahead.pending == nil {
+		file.ahead.pending = make(map[int64]*prefetch)
+	}
+	for i, pf := range pfs {
+		file.ahead.pending[start+int64(i)] = pf
+	}
+	file.ahead.wg.Add(1)
+	go func() {
+		defer file.ahead.wg.Done()
+		blocks, err := file.file.readBlocksInto(start, dsts)
+		file.mu.Lock()
+		defer file.mu.Unlock()
+		for i, pf := range pfs {
+			if i < len(blocks) {
+				pf.data = blocks[i]
+			} else {
+				pf.err = err
+			}
+			if pf.dropped || pf.err != nil {
+				file.putBuffer(pf.buf)
+				pf.buf, pf.data = nil, nil
+			}
+			close(pf.done)
+		}
+	}()
+}
+
+// takePrefetch removes the prefetch of block and returns it, or nil if block is not prefetched or blocks have been
+// written since the prefetch started. The caller must hold the lock, and wait for the prefetch to complete without
+// holding it.
+func (file *StreamFile) takePrefetch(block int64) *prefetch {
+	pf, ok := file.ahead.pending[block]
+	if !ok {
+		return nil
+	}
+	if pf.written != file.written {
+		file.dropPrefetch(block, pf)
+		return nil
+	}
+	delete(file.ahead.pending, block)
+	return pf
+}
+
+// dropPrefetch removes the prefetch of block and zeroes its data for reuse. The caller must hold the lock.
+func (file *StreamFile) dropPrefetch(block int64, pf *prefetch) {
+	delete(file.ahead.pending, block)
+	select {
+	case <-pf.done:
+		if pf.buf != nil {
+			file.putBuffer(pf.buf)
+		}
+	default:
+		pf.dropped = true
+	}
+}
+
+// dropReadAhead drops all prefetched blocks and resets the depth. The caller must hold the lock.
+func (file *StreamFile) dropReadAhead() {
+	for b, pf := range file.ahead.pending {
+		file.dropPrefetch(b, pf)
+	}
+	file.ahead.depth = 0
+}
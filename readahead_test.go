@@ -0,0 +1,96 @@
+package fullfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestStreamFileReadAhead(t *testing.T) {
+	transform := new(TestTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	sfile.SetCacheSize(2)
+	d := make([]byte, 32*40)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	sfile.Seek(0, io.SeekStart)
+	td := make([]byte, 20)
+	for i := 0; i < 10; i++ {
+		if _, err := sfile.Read(td); err != nil {
+			t.Fatalf("Read: %s", err)
+		} else if !bytes.Equal(td, d[i*20:(i+1)*20]) {
+			t.Errorf("False data %d:\n\t%x\n\t%x", i, d[i*20:(i+1)*20], td)
+		}
+	}
+	sfile.mu.Lock()
+	depth, pending := sfile.ahead.depth, len(sfile.ahead.pending)
+	sfile.mu.Unlock()
+	if depth != DefaultReadAhead {
+		t.Errorf("Read-ahead depth: %d!=%d", depth, DefaultReadAhead)
+	}
+	if pending == 0 {
+		t.Error("No blocks prefetched")
+	}
+	// Modified blocks are not read from stale prefetches
+	if _, err := sfile.WriteAt(bytes.Repeat([]byte{0xff}, 32*3), 32*7); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	copy(d[32*7:], bytes.Repeat([]byte{0xff}, 32*3))
+	rest := make([]byte, len(d)-200)
+	if _, err := sfile.Read(rest); err != nil {
+		t.Fatalf("Read: %s", err)
+	} else if !bytes.Equal(rest, d[200:]) {
+		t.Errorf("False data after write:\n\t%x\n\t%x", d[200:], rest)
+	}
+	// Seek stops read-ahead
+	sfile.Seek(0, io.SeekStart)
+	sfile.mu.Lock()
+	depth, pending = sfile.ahead.depth, len(sfile.ahead.pending)
+	sfile.mu.Unlock()
+	if depth != 0 || pending != 0 {
+		t.Errorf("Read-ahead not stopped: depth %d, pending %d", depth, pending)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+func TestStreamFileReadAheadInPlace(t *testing.T) {
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], newAESTransform())
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	defer sfile.Close()
+	sfile.SetCacheSize(1)
+	d := make([]byte, 4096*20)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	sfile.Seek(0, io.SeekStart)
+	td := make([]byte, 1000)
+	for pos := 0; pos < len(d); pos += len(td) {
+		n, err := sfile.Read(td)
+		if err != nil && err != io.EOF {
+			t.Fatalf("Read: %s", err)
+		} else if !bytes.Equal(td[:n], d[pos:pos+n]) {
+			t.Fatalf("False data at %d", pos)
+		}
+	}
+}
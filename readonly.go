@@ -0,0 +1,52 @@
+package fullfile
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrReadOnly is returned when writing to a BlockFile or StreamFile opened read-only.
+	ErrReadOnly = errors.New("file is opened read-only")
+)
+
+// NewReadOnlyBlockFile treats r as a BlockFile that is only read. Writes return ErrReadOnly, Sync does nothing and
+// Close never writes the header, so that the content and modification time of r remain unchanged. Reads happen in
+// parallel if r implements io.ReaderAt; an io.ReaderAt of known size can be opened via io.NewSectionReader. Close
+// closes r if it implements io.Closer.
+func NewReadOnlyBlockFile(r io.ReadSeeker, transform Transform) (*BlockFile, error) {
+	return newBlockFile(context.Background(), newReadOnlyFile(r), transform, blockFileConfig{readOnly: true})
+}
+
+// newReadOnlyFile adapts r to the ReadWriteCloseSeeker of a read-only BlockFile, keeping support for io.ReaderAt.
+func newReadOnlyFile(r io.ReadSeeker) ReadWriteCloseSeeker {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return readOnlyFileAt{readOnlyFile{r}, ra}
+	}
+	return readOnlyFile{r}
+}
+
+// readOnlyFile is an io.ReadSeeker that rejects writes.
+type readOnlyFile struct {
+	io.ReadSeeker
+}
+
+// Write returns ErrReadOnly.
+func (f readOnlyFile) Write(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// Close closes the io.ReadSeeker, if it is an io.Closer.
+func (f readOnlyFile) Close() error {
+	if c, ok := f.ReadSeeker.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// readOnlyFileAt is a readOnlyFile that supports parallel reads.
+type readOnlyFileAt struct {
+	readOnlyFile
+	io.ReaderAt
+}
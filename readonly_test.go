@@ -0,0 +1,67 @@
+package fullfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	transform := new(TestTransform)
+	bfile, err := OpenBlockFile(path, transform, nil)
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	d := bytes.Repeat([]byte{0x55}, transform.DataSize())
+	if err := bfile.WriteBlockAt(0, d); err != nil {
+		t.Fatalf("WriteBlockAt: %s", err)
+	}
+	if err := bfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if bfile, err = OpenBlockFile(path, transform, &OpenOptions{ReadOnly: true}); err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	if td, err := bfile.ReadBlockAt(0, nil); err != nil {
+		t.Fatalf("ReadBlockAt: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Errorf("False data:\n\t%x\n\t%x", d, td)
+	}
+	if err := bfile.WriteBlockAt(1, d); err != ErrReadOnly {
+		t.Errorf("WriteBlockAt: %v", err)
+	}
+	if err := bfile.Truncate(0); err != ErrReadOnly {
+		t.Errorf("Truncate: %v", err)
+	}
+	sfile := NewStreamFile(bfile)
+	if _, err := sfile.Write([]byte("x")); err != ErrReadOnly {
+		t.Errorf("StreamFile Write: %v", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Errorf("Sync: %s", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if after, err := ioutil.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	} else if !bytes.Equal(after, content) {
+		t.Error("File changed by read-only access")
+	}
+	// Any io.ReadSeeker can be opened
+	if bfile, err = NewReadOnlyBlockFile(bytes.NewReader(content), transform); err != nil {
+		t.Fatalf("NewReadOnlyBlockFile: %s", err)
+	}
+	defer bfile.Close()
+	if td, err := bfile.ReadBlockAt(0, nil); err != nil {
+		t.Fatalf("ReadBlockAt: %s", err)
+	} else if !bytes.Equal(td, d) {
+		t.Errorf("False data:\n\t%x\n\t%x", d, td)
+	}
+}
@@ -0,0 +1,90 @@
+package fullfile
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrDestroyed is returned when accessing a SecureBuffer after Destroy.
+	ErrDestroyed = errors.New("secure buffer destroyed")
+)
+
+// SecureBuffer is memory for key material and plaintext. Where supported, it is allocated outside of the Go heap,
+// locked into RAM, excluded from core dumps and surrounded by guard pages. Destroy must be called to release it.
+// If the limit of locked memory of the process (RLIMIT_MEMLOCK) is exhausted, buffers are allocated without locking,
+// but still excluded from core dumps.
+type SecureBuffer struct {
+	mu   sync.Mutex
+	mem  []byte // the complete allocation, including guard pages.
+	data []byte // the usable part of mem.
+}
+
+var secureBuffers = struct {
+	sync.Mutex
+	buffers map[*SecureBuffer]struct{}
+}{
+	buffers: make(map[*SecureBuffer]struct{}),
+}
+
+// NewSecureBuffer allocates a zeroed SecureBuffer of size bytes.
+func NewSecureBuffer(size int) (*SecureBuffer, error) {
+	if err := checkPanic(); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, errors.New("secure buffer size must be positive")
+	}
+	mem, data, err := secureAlloc(size)
+	if err != nil {
+		return nil, err
+	}
+	b := &SecureBuffer{
+		mem:  mem,
+		data: data,
+	}
+	secureBuffers.Lock()
+	secureBuffers.buffers[b] = struct{}{}
+	secureBuffers.Unlock()
+	return b, nil
+}
+
+// Bytes returns the content of the buffer. The slice must not be used after Destroy.
+func (b *SecureBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data
+}
+
+// Len returns the size of the buffer, or 0 after Destroy.
+func (b *SecureBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.data)
+}
+
+// Destroy zeroes and releases the buffer. It can be called more than once.
+func (b *SecureBuffer) Destroy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.data == nil {
+		return
+	}
+	clear(b.data)
+	// Unregister before unmapping, so that zeroSecureBuffers never writes to released memory.
+	secureBuffers.Lock()
+	delete(secureBuffers.buffers, b)
+	secureBuffers.Unlock()
+	secureFree(b.mem)
+	b.mem, b.data = nil, nil
+}
+
+// zeroSecureBuffers zeroes all live secure buffers without releasing them, since they might still be referenced.
+// Buffers are only released after they have been removed from the registry.
+func zeroSecureBuffers() {
+	secureBuffers.Lock()
+	defer secureBuffers.Unlock()
+	for b := range secureBuffers.buffers {
+		clear(b.data)
+	}
+}
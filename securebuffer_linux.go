@@ -0,0 +1,54 @@
+//go:build linux
+
+package fullfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// madvDontDump excludes memory from core dumps. It is missing from package syscall.
+const madvDontDump = 0x10
+
+// secureAlloc maps size bytes surrounded by guard pages. The data is aligned to the end of the mapped pages, so
+// that overflows hit the trailing guard page immediately.
+func secureAlloc(size int) (mem, data []byte, err error) {
+	pageSize := os.Getpagesize()
+	dataLen := ((size + pageSize - 1) / pageSize) * pageSize
+	mem, err = syscall.Mmap(-1, 0, dataLen+2*pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, nil, err
+	}
+	inner := mem[pageSize : pageSize+dataLen : pageSize+dataLen]
+	if err = secureProtect(mem, inner, pageSize); err != nil {
+		syscall.Munmap(mem)
+		return nil, nil, err
+	}
+	return mem, inner[dataLen-size:], nil
+}
+
+// secureProtect turns the first and last page of mem into guard pages and locks inner into RAM. If locking fails
+// because the limit of locked memory is reached or not permitted, inner is left unlocked.
+func secureProtect(mem, inner []byte, pageSize int) error {
+	if err := syscall.Mprotect(mem[:pageSize], syscall.PROT_NONE); err != nil {
+		return err
+	}
+	if err := syscall.Mprotect(mem[len(mem)-pageSize:], syscall.PROT_NONE); err != nil {
+		return err
+	}
+	if err := syscall.Mlock(inner); err != nil && err != syscall.ENOMEM && err != syscall.EPERM && err != syscall.EAGAIN {
+		return err
+	}
+	if err := syscall.Madvise(inner, madvDontDump); err != nil {
+		syscall.Munlock(inner)
+		return err
+	}
+	return nil
+}
+
+// secureFree unlocks and unmaps memory allocated by secureAlloc. Unlocking memory that is not locked does no harm.
+func secureFree(mem []byte) {
+	pageSize := os.Getpagesize()
+	syscall.Munlock(mem[pageSize : len(mem)-pageSize])
+	syscall.Munmap(mem)
+}
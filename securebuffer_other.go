@@ -0,0 +1,12 @@
+//go:build !linux
+
+package fullfile
+
+// secureAlloc allocates size bytes on the heap. Memory locking and guard pages are not supported on this platform.
+func secureAlloc(size int) (mem, data []byte, err error) {
+	mem = make([]byte, size)
+	return mem, mem, nil
+}
+
+// secureFree releases memory allocated by secureAlloc.
+func secureFree(mem []byte) {}
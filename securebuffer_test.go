@@ -0,0 +1,30 @@
+package fullfile
+
+import (
+	"testing"
+)
+
+func TestSecureBuffer(t *testing.T) {
+	b, err := NewSecureBuffer(100)
+	if err != nil {
+		t.Fatalf("NewSecureBuffer: %s", err)
+	}
+	if b.Len() != 100 {
+		t.Errorf("Wrong length: %d!=%d", b.Len(), 100)
+	}
+	d := b.Bytes()
+	for i := range d {
+		if d[i] != 0 {
+			t.Fatalf("Buffer not zeroed at %d", i)
+		}
+		d[i] = byte(i)
+	}
+	b.Destroy()
+	if b.Len() != 0 || b.Bytes() != nil {
+		t.Error("Buffer accessible after Destroy")
+	}
+	b.Destroy()
+	if _, err := NewSecureBuffer(0); err == nil {
+		t.Error("Zero size buffer must fail")
+	}
+}
@@ -0,0 +1,314 @@
+package fullfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SplitFile is a file stored in chunk files of a fixed size, named name.000, name.001 and so on, for file systems
+// and services that cannot handle large files. All chunks but the last have the full size. Chunks are created when
+// the file grows and removed when it is truncated. The chunks must not be changed by other processes while the file
+// is open. SplitFile is safe for concurrent use.
+type SplitFile struct {
+	name      string
+	chunkSize int64
+	flag      int
+	perm      os.FileMode
+	rw        sync.RWMutex // held exclusively while chunks are added or removed.
+	chunks    []*os.File
+	dirtyMu   sync.Mutex
+	dirty     map[int]struct{} // chunks written since the last Sync.
+	dirDirty  bool             // chunks have been created or removed since the last Sync.
+	size      int64
+	closed    bool
+	mu        sync.Mutex // protects pos.
+	pos       int64
+}
+
+// OpenSplitFile opens the file stored in the chunks of name, like os.OpenFile. With os.O_CREATE, the first chunk is
+// created if no chunk exists. O_APPEND is not supported. chunkSize must be the same whenever the file is opened.
+func OpenSplitFile(name string, chunkSize int64, flag int, perm os.FileMode) (*SplitFile, error) {
+	if chunkSize <= 0 || flag&os.O_APPEND != 0 {
+		return nil, os.ErrInvalid
+	}
+	f := &SplitFile{
+		name:      name,
+		chunkSize: chunkSize,
+		flag:      flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC),
+		perm:      perm,
+		dirty:     make(map[int]struct{}),
+		dirDirty:  flag&os.O_CREATE != 0,
+	}
+	first, err := os.OpenFile(f.chunkName(0), flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	f.chunks = append(f.chunks, first)
+	for {
+		c, err := os.OpenFile(f.chunkName(len(f.chunks)), f.flag, perm)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			f.closeChunks()
+			return nil, err
+		}
+		f.chunks = append(f.chunks, c)
+	}
+	fi, err := f.chunks[len(f.chunks)-1].Stat()
+	if err != nil {
+		f.closeChunks()
+		return nil, err
+	}
+	f.size = int64(len(f.chunks)-1)*chunkSize + fi.Size()
+	if flag&os.O_TRUNC != 0 {
+		if err := f.truncate(0); err != nil {
+			f.closeChunks()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// chunkName returns the name of chunk n.
+func (f *SplitFile) chunkName(n int) string {
+	return fmt.Sprintf("%s.%03d", f.name, n)
+}
+
+// closeChunks closes all chunks.
+func (f *SplitFile) closeChunks() error {
+	var err error
+	for _, c := range f.chunks {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	f.chunks = nil
+	return err
+}
+
+// ReadAt reads len(p) bytes at offset off. It implements io.ReaderAt.
+func (f *SplitFile) ReadAt(p []byte, off int64) (int, error) {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for n < len(p) && off < f.size {
+		chunk, pos, l := chunkSpan(off, min64(int64(len(p)-n), f.size-off), f.chunkSize)
+		m, err := f.chunks[chunk].ReadAt(p[n:n+int(l)], pos)
+		if err != nil && err != io.EOF {
+			return n + m, err
+		}
+		n += m
+		off += int64(m)
+		if int64(m) < l {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off. It implements io.WriterAt. Writing past the end creates chunks as needed.
+func (f *SplitFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	end := off + int64(len(p))
+	f.rw.RLock()
+	if f.closed {
+		f.rw.RUnlock()
+		return 0, os.ErrClosed
+	}
+	if end <= f.size {
+		defer f.rw.RUnlock()
+		return f.writeAt(p, off)
+	}
+	f.rw.RUnlock()
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if end > f.size {
+		if err := f.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at offset off, which must be inside the file. f.rw must be held.
+func (f *SplitFile) writeAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk, pos, l := chunkSpan(off, int64(len(p)-n), f.chunkSize)
+		m, err := f.chunks[chunk].WriteAt(p[n:n+int(l)], pos)
+		f.setDirty(int(chunk))
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// setDirty marks chunk n to be synced. It is called after writing, since Sync clears the mark before syncing.
+func (f *SplitFile) setDirty(n int) {
+	f.dirtyMu.Lock()
+	f.dirty[n] = struct{}{}
+	f.dirtyMu.Unlock()
+}
+
+// truncate changes the size of the file, creating and removing chunks. f.rw must be held exclusively.
+func (f *SplitFile) truncate(size int64) error {
+	last := 0
+	if size > 0 {
+		last = int((size - 1) / f.chunkSize)
+	}
+	for len(f.chunks) > last+1 {
+		n := len(f.chunks) - 1
+		if err := f.chunks[n].Close(); err != nil {
+			return err
+		}
+		f.chunks = f.chunks[:n]
+		f.dirtyMu.Lock()
+		delete(f.dirty, n)
+		f.dirDirty = true
+		f.dirtyMu.Unlock()
+		if err := os.Remove(f.chunkName(n)); err != nil {
+			return err
+		}
+	}
+	for len(f.chunks) <= last {
+		if err := f.chunks[len(f.chunks)-1].Truncate(f.chunkSize); err != nil {
+			return err
+		}
+		f.setDirty(len(f.chunks) - 1)
+		c, err := os.OpenFile(f.chunkName(len(f.chunks)), f.flag|os.O_CREATE, f.perm)
+		if err != nil {
+			return err
+		}
+		f.chunks = append(f.chunks, c)
+		f.dirtyMu.Lock()
+		f.dirDirty = true
+		f.dirtyMu.Unlock()
+	}
+	if err := f.chunks[last].Truncate(size - int64(last)*f.chunkSize); err != nil {
+		return err
+	}
+	f.setDirty(last)
+	f.size = size
+	return nil
+}
+
+// Read reads from the current position.
+func (f *SplitFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current position.
+func (f *SplitFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the current position.
+func (f *SplitFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.rw.RLock()
+		offset += f.size
+		f.rw.RUnlock()
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+// Truncate changes the size of the file.
+func (f *SplitFile) Truncate(size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.truncate(size)
+}
+
+// Sync flushes the chunks written since the last Sync to stable storage, followed by the directory if chunks have
+// been created or removed. Writes that run concurrently with Sync are flushed by the next Sync.
+func (f *SplitFile) Sync() error {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.dirtyMu.Lock()
+	dirty, dirDirty := f.dirty, f.dirDirty
+	f.dirty, f.dirDirty = make(map[int]struct{}), false
+	f.dirtyMu.Unlock()
+	var err error
+	for n := range dirty {
+		if err = f.chunks[n].Sync(); err != nil {
+			break
+		}
+		delete(dirty, n)
+	}
+	if err == nil && dirDirty {
+		err = syncDir(filepath.Dir(f.name))
+	}
+	if err != nil {
+		// Keep what has not been synced for the next Sync
+		f.dirtyMu.Lock()
+		for n := range dirty {
+			f.dirty[n] = struct{}{}
+		}
+		f.dirDirty = f.dirDirty || dirDirty
+		f.dirtyMu.Unlock()
+	}
+	return err
+}
+
+// Close closes all chunks.
+func (f *SplitFile) Close() error {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return f.closeChunks()
+}
@@ -0,0 +1,95 @@
+package fullfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSplitFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	transform := new(TestTransform)
+	bfile, err := OpenBlockFile(path, transform, &OpenOptions{ChunkSize: 1000})
+	if err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := make([]byte, 32*100)
+	rand.New(rand.NewSource(1)).Read(d)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	// 48+100*96 bytes in chunks of 1000 bytes
+	for i, size := range []int64{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 648} {
+		if fi, err := os.Stat(fmt.Sprintf("%s.%03d", path, i)); err != nil {
+			t.Fatalf("Stat: %s", err)
+		} else if fi.Size() != size {
+			t.Errorf("Chunk %d size: %d!=%d", i, fi.Size(), size)
+		}
+	}
+	if err := sfile.Truncate(32 * 20); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if _, err := os.Stat(path + ".002"); !os.IsNotExist(err) {
+		t.Errorf("Chunk not removed: %v", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if bfile, err = OpenBlockFile(path, transform, &OpenOptions{ChunkSize: 1000, ReadOnly: true}); err != nil {
+		t.Fatalf("OpenBlockFile: %s", err)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	td := make([]byte, len(d))
+	if n, err := io.ReadFull(sfile, td); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read past end: %v", err)
+	} else if !bytes.Equal(td[:n], d[:32*20]) {
+		t.Errorf("False data:\n\t%x\n\t%x", d[:32*20], td[:n])
+	}
+}
+
+func TestSplitFileSync(t *testing.T) {
+	f, err := OpenSplitFile(filepath.Join(t.TempDir(), "vault"), 100, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenSplitFile: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(make([]byte, 250), 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+	if !f.dirDirty {
+		t.Error("Directory not marked for Sync")
+	}
+	// Writes running concurrently with Sync stay marked until a later Sync
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := f.WriteAt([]byte{byte(j)}, int64(i*60+j)); err != nil {
+					t.Errorf("WriteAt: %s", err)
+				}
+				if err := f.Sync(); err != nil {
+					t.Errorf("Sync: %s", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if len(f.dirty) != 0 || f.dirDirty {
+		t.Errorf("Still marked after Sync: %d chunks, directory %t", len(f.dirty), f.dirDirty)
+	}
+}
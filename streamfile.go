@@ -2,6 +2,8 @@ package fullfile
 
 import (
 	"io"
+	"os"
+	"sync"
 )
 
 /*
@@ -14,13 +16,29 @@ type ReadWriteCloseSeeker interface {
 */
 
 // StreamFile turns a BlockFile into one that can be accessed bytewise.
+// Decrypted blocks are kept in a LRU cache. Writes modify cached blocks and are written to the BlockFile on eviction,
+// Sync and Close. When Read is called sequentially, the following blocks are prefetched in the background.
+// The BlockFile should not be modified directly while a StreamFile is in use. If it is, and the transform is a
+// Generationer, the StreamFile detects the change by the generation once it is synced, and drops the blocks it
+// cached that are not modified. The length of the file is a multiple of
+// the data size of the blocks, unless the transform is a Lengther that stores the exact length in the header.
+//
+// StreamFile is safe for concurrent use. Its lock protects the cache and is held for the whole of a write. Reads only
+// hold it for cache lookups, so that blocks missing from the cache are read and decrypted in parallel. The seek
+// position used by Read, Write and Seek is shared by all goroutines; concurrent users should use ReadAt and WriteAt.
 type StreamFile struct {
-	file       *BlockFile
-	datasize   int64
-	pos        int64  // the current byte position.
-	block      int64  // the current block number.
-	cacheBlock int64  // the currently cached block.
-	cache      []byte // the currently cached block data.
+	mu       sync.Mutex // protects all fields below.
+	file     *BlockFile
+	datasize int64
+	pos      int64           // the current byte position.
+	block    int64           // the current block number.
+	end      int64           // the number of blocks, including those only cached. -1 if unknown.
+	size     int64           // the length of the file in bytes, valid if end is known.
+	written  int64           // counts writes to the BlockFile, to detect stale reads.
+	gen      uint64          // the generation of the BlockFile that the cache reflects.
+	cache    *blockCache     // decrypted blocks.
+	spare    []*SecureBuffer // zeroed buffers for reuse, at most as many as the cache size.
+	ahead    readAhead       // prefetched blocks.
 }
 
 // NewStreamFile wraps.
@@ -28,24 +46,137 @@ func NewStreamFile(f *BlockFile) *StreamFile {
 	return &StreamFile{
 		file:     f,
 		datasize: int64(f.DataSize()),
+		end:      -1,
+		gen:      f.Generation(),
+		cache:    newBlockCache(DefaultCacheSize),
+		ahead:    readAhead{max: DefaultReadAhead},
 	}
 }
 
-// Close the file.
+// SetCacheSize sets the number of decrypted blocks to cache. It must be at least 1. Dirty blocks that do not fit
+// into the cache anymore are written.
+func (file *StreamFile) SetCacheSize(blocks int) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if blocks < 1 {
+		blocks = 1
+	}
+	file.cache.size = blocks
+	for file.cache.lru.Len() > blocks {
+		if err := file.evict(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync writes all modified blocks and syncs the BlockFile.
+func (file *StreamFile) Sync() error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if err := file.flush(); err != nil {
+		return err
+	}
+	err := file.file.Sync()
+	file.gen = file.file.Generation()
+	return err
+}
+
+// Close the file. Modified blocks are written and the cache is zeroed.
 func (file *StreamFile) Close() error {
-	return file.file.Close()
+	file.mu.Lock()
+	file.dropReadAhead()
+	file.mu.Unlock()
+	file.ahead.wg.Wait()
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	err := file.flush()
+	file.cache.destroy()
+	for _, buf := range file.spare {
+		buf.Destroy()
+	}
+	file.spare = nil
+	if cerr := file.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-// Seek to offset, relative to whence.
-func (file *StreamFile) Seek(offset int64, whence int) (int64, error) {
-	block := offset / file.datasize
-	blockByte := offset % file.datasize
-	newBlock, err := file.file.SeekBlock(block, whence)
+// Truncate changes the size of the file to size bytes. Unless the transform is a Lengther, the size is rounded up to
+// full blocks. The data following size in the new last block is zeroed. Discarded blocks are wiped as described for
+// BlockFile.Truncate.
+func (file *StreamFile) Truncate(size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if file.file.readOnly {
+		return ErrReadOnly
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	file.dropReadAhead()
+	blocks := (size + file.datasize - 1) / file.datasize
+	for _, entry := range file.cache.all() {
+		if entry.block >= blocks {
+			file.cache.remove(entry).Destroy()
+		}
+	}
+	if blocks > 0 {
+		end, err := file.numBlocks()
+		if err != nil {
+			return err
+		}
+		offset := size % file.datasize
+		if offset != 0 || blocks > end {
+			entry, err := file.getBlock(blocks-1, true)
+			if err != nil {
+				return err
+			}
+			if offset != 0 {
+				clear(entry.data[offset:])
+			}
+			entry.dirty = true
+		}
+	}
+	if err := file.flush(); err != nil {
+		return err
+	}
+	file.setSize(size)
+	err := file.file.Truncate(blocks)
+	file.gen = file.file.Generation()
 	if err != nil {
-		return 0, err
+		return err
+	}
+	file.end = blocks
+	return nil
+}
+
+// Seek to offset, relative to whence. Seeking before the beginning of the file returns os.ErrInvalid.
+func (file *StreamFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = file.pos + offset
+	case io.SeekEnd:
+		if _, err := file.numBlocks(); err != nil {
+			return file.pos, err
+		}
+		pos = file.size + offset
+	default:
+		return file.pos, os.ErrInvalid
+	}
+	if pos < 0 {
+		return file.pos, os.ErrInvalid
 	}
-	file.block = newBlock
-	file.pos = (file.block * file.datasize) + blockByte
+	if block := pos / file.datasize; block != file.ahead.next && block != file.ahead.next-1 {
+		file.dropReadAhead()
+	}
+	file.pos = pos
+	file.block = pos / file.datasize
 	return file.pos, nil
 }
 
@@ -56,28 +187,318 @@ func min(a, b int) int {
 	return b
 }
 
-func (file *StreamFile) readBlock(d []byte) ([]byte, error) {
-	// ToDo: Add caching
-	return file.file.ReadBlock(nil)
+// numBlocks returns the number of blocks of the file, including blocks that have not been written yet. The cache is
+// revalidated first.
+func (file *StreamFile) numBlocks() (int64, error) {
+	file.revalidate()
+	if file.end < 0 {
+		n, err := file.file.NumBlocks()
+		if err != nil {
+			return 0, err
+		}
+		file.setEnd(n)
+	}
+	return file.end, nil
 }
 
-// read the next bytes into p. This only reads one block. For larger p, the read has to be repeated.
-func (file *StreamFile) read(p []byte) (n int, err error) {
-	block := file.pos / file.datasize
-	offset := int(file.pos % file.datasize)
-	if _, err := file.file.SeekBlock(block, io.SeekStart); err != nil {
+// revalidate drops the cached blocks that are not dirty, and the number of blocks unless dirty blocks are left, if
+// the generation of the BlockFile changed since the StreamFile last synced it.
+func (file *StreamFile) revalidate() {
+	gen := file.file.Generation()
+	if gen == file.gen {
+		return
+	}
+	file.gen = gen
+	file.dropReadAhead()
+	// Blocks being read are not cached either
+	file.written++
+	for _, entry := range file.cache.all() {
+		if !entry.dirty {
+			file.putBuffer(file.cache.remove(entry))
+		}
+	}
+	if len(file.cache.dirty()) == 0 {
+		file.end = -1
+	}
+}
+
+// setEnd sets the number of blocks as read from the BlockFile, and the length of the file: the length stored by a
+// Lengther transform, if any, or the size of all blocks.
+func (file *StreamFile) setEnd(end int64) {
+	file.end = end
+	file.size = end * file.datasize
+	if l, ok := file.file.transform.(Lengther); ok {
+		if n := l.Length(); n >= 0 && n < file.size {
+			file.size = n
+		}
+	}
+}
+
+// setSize sets the length of the file and passes it to a Lengther transform. Without Lengther, the length is rounded
+// up to full blocks.
+func (file *StreamFile) setSize(size int64) {
+	if l, ok := file.file.transform.(Lengther); ok {
+		l.SetLength(size)
+	} else {
+		size = (size + file.datasize - 1) / file.datasize * file.datasize
+	}
+	file.size = size
+}
+
+// extend sets the length of the file to end, if it is shorter. The number of blocks must be known.
+func (file *StreamFile) extend(end int64) {
+	if end > file.size {
+		file.setSize(end)
+	}
+}
+
+// getBlock returns the cache entry of block. If the block is not cached and load is true, it is read from the
+// BlockFile. Otherwise, or if the block does not exist in the BlockFile, the entry contains zeros.
+func (file *StreamFile) getBlock(block int64, load bool) (*cacheEntry, error) {
+	if entry := file.cache.get(block); entry != nil {
+		return entry, nil
+	}
+	stored, err := file.file.NumBlocks()
+	if err != nil {
+		return nil, err
+	}
+	var entry *cacheEntry
+	if file.cache.full() {
+		if entry, err = file.reuse(block); err != nil {
+			return nil, err
+		}
+	} else {
+		buf, err := file.getBuffer()
+		if err != nil {
+			return nil, err
+		}
+		entry = &cacheEntry{
+			block: block,
+			buf:   buf,
+			data:  buf.Bytes()[:file.datasize],
+		}
+		file.cache.add(entry)
+	}
+	if load && block < stored {
+		if entry.data, err = file.file.ReadBlockAt(block, entry.buf.Bytes()); err != nil {
+			file.putBuffer(file.cache.remove(entry))
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+// reuse writes the least recently used entry, if dirty, and reuses it with its buffer for block.
+func (file *StreamFile) reuse(block int64) (*cacheEntry, error) {
+	entry := file.cache.oldest()
+	if entry.dirty {
+		if err := file.writeEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	file.cache.replace(entry, block, entry.buf, entry.buf.Bytes()[:file.datasize])
+	return entry, nil
+}
+
+// getBuffer returns a spare buffer of BlockSize bytes, or allocates one.
+func (file *StreamFile) getBuffer() (*SecureBuffer, error) {
+	if n := len(file.spare); n > 0 {
+		buf := file.spare[n-1]
+		file.spare = file.spare[:n-1]
+		return buf, nil
+	}
+	return NewSecureBuffer(file.file.BlockSize())
+}
+
+// putBuffer zeroes buf and keeps it for reuse, or destroys it if enough buffers are spare.
+func (file *StreamFile) putBuffer(buf *SecureBuffer) {
+	if len(file.spare) >= file.cache.size {
+		buf.Destroy()
+		return
+	}
+	clear(buf.Bytes())
+	file.spare = append(file.spare, buf)
+}
+
+// evict removes the least recently used entry from the cache and destroys its buffer.
+func (file *StreamFile) evict() error {
+	entry := file.cache.oldest()
+	if entry == nil {
+		return nil
+	}
+	if entry.dirty {
+		if err := file.writeEntry(entry); err != nil {
+			return err
+		}
+	}
+	file.cache.remove(entry).Destroy()
+	return nil
+}
+
+// writeEntry writes a cached block to the BlockFile. Missing blocks before it are left as holes, see BlockFile.
+func (file *StreamFile) writeEntry(entry *cacheEntry) error {
+	if err := file.writeBlock(entry.block, entry.data); err != nil {
+		return err
+	}
+	entry.dirty = false
+	return nil
+}
+
+// writeEntries writes cached consecutive blocks to the BlockFile with a single write.
+func (file *StreamFile) writeEntries(entries []*cacheEntry) error {
+	blocks := make([][]byte, len(entries))
+	for i, entry := range entries {
+		blocks[i] = entry.data
+	}
+	file.written++
+	if err := file.file.WriteBlocks(entries[0].block, blocks); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry.dirty = false
+	}
+	return nil
+}
+
+// writeBlock writes d as block.
+func (file *StreamFile) writeBlock(block int64, d []byte) error {
+	file.written++
+	return file.file.WriteBlockAt(block, d)
+}
+
+// flush writes all dirty blocks in order. Runs of consecutive blocks are written with a single write.
+func (file *StreamFile) flush() error {
+	dirty := file.cache.dirty()
+	for len(dirty) > 0 {
+		run := 1
+		for run < len(dirty) && dirty[run].block == dirty[0].block+int64(run) {
+			run++
+		}
+		if err := file.writeEntries(dirty[:run]); err != nil {
+			return err
+		}
+		dirty = dirty[run:]
+	}
+	return nil
+}
+
+// readAt reads bytes from off into p. This only reads one block. For larger p, the read has to be repeated.
+// Blocks missing from the cache are read without holding the lock, and are only cached if no block was written to
+// the BlockFile in the meantime.
+func (file *StreamFile) readAt(p []byte, off int64) (n int, err error) {
+	block := off / file.datasize
+	offset := int(off % file.datasize)
+	m := min(len(p), int(file.datasize)-offset)
+	file.mu.Lock()
+	if _, err := file.numBlocks(); err != nil {
+		file.mu.Unlock()
 		return 0, err
 	}
-	d, err := file.readBlock(nil)
+	if off >= file.size {
+		file.mu.Unlock()
+		return 0, io.EOF
+	}
+	m = int(min64(int64(m), file.size-off))
+	if entry := file.cache.get(block); entry != nil {
+		copy(p[:m], entry.data[offset:offset+m])
+		file.mu.Unlock()
+		return m, nil
+	}
+	stored, err := file.file.NumBlocks()
 	if err != nil {
+		file.mu.Unlock()
 		return 0, err
 	}
-	m := min(len(p), len(d)-offset)
+	if block >= stored {
+		file.mu.Unlock()
+		clear(p[:m])
+		return m, nil
+	}
+	written := file.written
+	pf := file.takePrefetch(block)
+	var buf *SecureBuffer
+	if pf == nil {
+		if buf, err = file.getBuffer(); err != nil {
+			file.mu.Unlock()
+			return 0, err
+		}
+	}
+	file.mu.Unlock()
+	var d []byte
+	if pf != nil {
+		<-pf.done
+		if pf.err == nil {
+			buf, d, written = pf.buf, pf.data, pf.written
+		} else if buf, err = NewSecureBuffer(file.file.BlockSize()); err != nil {
+			return 0, err
+		}
+	}
+	if d == nil {
+		if d, err = file.file.ReadBlockAt(block, buf.Bytes()); err != nil {
+			file.mu.Lock()
+			file.putBuffer(buf)
+			file.mu.Unlock()
+			return 0, err
+		}
+	}
 	copy(p[:m], d[offset:offset+m])
-	file.pos += int64(m)
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.written != written || file.cache.get(block) != nil {
+		file.putBuffer(buf)
+		return m, nil
+	}
+	if file.cache.full() {
+		entry := file.cache.oldest()
+		if entry.dirty {
+			if err := file.writeEntry(entry); err != nil {
+				file.putBuffer(buf)
+				return m, err
+			}
+		}
+		file.putBuffer(file.cache.replace(entry, block, buf, d))
+		return m, nil
+	}
+	file.cache.add(&cacheEntry{
+		block: block,
+		buf:   buf,
+		data:  d,
+	})
 	return m, nil
 }
 
+// ReadAt reads len(p) bytes from offset off into p. It returns io.EOF if fewer bytes are available.
+func (file *StreamFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	for n < len(p) {
+		m, err := file.readAt(p[n:], off+int64(n))
+		if err != nil {
+			return n + m, err
+		}
+		n = n + m
+	}
+	return n, nil
+}
+
+// read the next bytes into p. This only reads one block. For larger p, the read has to be repeated.
+func (file *StreamFile) read(p []byte) (n int, err error) {
+	file.mu.Lock()
+	pos := file.pos
+	err = file.readAhead(pos / file.datasize)
+	file.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n, err = file.readAt(p, pos)
+	file.mu.Lock()
+	file.pos = pos + int64(n)
+	file.block = file.pos / file.datasize
+	file.mu.Unlock()
+	return n, err
+}
+
 // Read into p.
 func (file *StreamFile) Read(p []byte) (n int, err error) {
 	for n < len(p) {
@@ -90,7 +511,63 @@ func (file *StreamFile) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-// Write p to file.
+// writeAt writes p at offset off. This only writes one block. For larger p, the write has to be repeated.
+// Partial blocks are read and patched. Writes past the end of the file extend it, leaving holes that read as zeros.
+func (file *StreamFile) writeAt(p []byte, off int64) (n int, err error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	return file.patch(p, off)
+}
+
+// patch writes p at offset off into the cached block. This only writes one block. The caller must hold the lock.
+func (file *StreamFile) patch(p []byte, off int64) (n int, err error) {
+	if file.file.readOnly {
+		return 0, ErrReadOnly
+	}
+	block := off / file.datasize
+	offset := int(off % file.datasize)
+	m := min(len(p), int(file.datasize)-offset)
+	end, err := file.numBlocks()
+	if err != nil {
+		return 0, err
+	}
+	entry, err := file.getBlock(block, m < int(file.datasize))
+	if err != nil {
+		return 0, err
+	}
+	copy(entry.data[offset:offset+m], p[:m])
+	entry.dirty = true
+	if block >= end {
+		file.end = block + 1
+	}
+	file.extend(off + int64(m))
+	return m, nil
+}
+
+// WriteAt writes p at offset off.
+func (file *StreamFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	for n < len(p) {
+		m, err := file.writeAt(p[n:], off+int64(n))
+		if err != nil {
+			return n + m, err
+		}
+		n = n + m
+	}
+	return n, nil
+}
+
+// Write p to file at the current position.
 func (file *StreamFile) Write(p []byte) (n int, err error) {
-	return 0, nil
+	file.mu.Lock()
+	pos := file.pos
+	file.mu.Unlock()
+	n, err = file.WriteAt(p, pos)
+	file.mu.Lock()
+	file.pos = pos + int64(n)
+	file.block = file.pos / file.datasize
+	file.mu.Unlock()
+	return n, err
 }
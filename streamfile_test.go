@@ -2,9 +2,12 @@ package fullfile
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -18,11 +21,7 @@ func TestStreamFile(t *testing.T) {
 	bf = append(bf, b3[:]...)
 
 	transform := new(TestTransform)
-	file, err := ioutil.TempFile("", "teststreamfile.")
-	if err != nil {
-		t.Fatalf("TempFile: %s", err)
-	}
-	defer os.Remove(file.Name())
+	file := NewMemFile()
 	defer file.Close()
 	bfile, err := NewBlockFile(file, transform)
 	if err != nil {
@@ -141,3 +140,372 @@ func TestStreamFile(t *testing.T) {
 	}
 	sfile.Seek(0, io.SeekStart)
 }
+
+func TestStreamFileWrite(t *testing.T) {
+	transform := new(TestTransform)
+	file := NewMemFile()
+	defer file.Close()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	expect := make([]byte, 0, 200)
+	d := make([]byte, 100)
+	for i := range d {
+		d[i] = byte(i + 1)
+	}
+	// Unaligned write into empty file
+	if _, err := sfile.Seek(10, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %s", err)
+	}
+	if n, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	} else if n != len(d) {
+		t.Errorf("Write length mismatch: %d!=%d", n, len(d))
+	}
+	expect = append(expect, make([]byte, 10)...)
+	expect = append(expect, d...)
+	expect = append(expect, make([]byte, 18)...)
+	// Partial overwrite across a block boundary
+	if pos, err := sfile.Seek(-90, io.SeekCurrent); err != nil {
+		t.Fatalf("Seek current: %s", err)
+	} else if pos != 20 {
+		t.Errorf("Wrong seek pos: %d!=%d", pos, 20)
+	}
+	if _, err := sfile.Write([]byte("0123456789ABCDEFGHIJ")); err != nil {
+		t.Fatalf("Write overwrite: %s", err)
+	}
+	copy(expect[20:], "0123456789ABCDEFGHIJ")
+	// Write past the end
+	if pos, err := sfile.Seek(30, io.SeekEnd); err != nil {
+		t.Fatalf("Seek end: %s", err)
+	} else if pos != 158 {
+		t.Errorf("Wrong seek end pos: %d!=%d", pos, 158)
+	}
+	if _, err := sfile.Write([]byte("end")); err != nil {
+		t.Fatalf("Write past end: %s", err)
+	}
+	expect = append(expect, make([]byte, 30)...)
+	expect = append(expect, "end"...)
+	expect = append(expect, make([]byte, 31)...)
+	if pos, err := sfile.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek end: %s", err)
+	} else if pos != int64(len(expect)) {
+		t.Errorf("Wrong file size: %d!=%d", pos, len(expect))
+	}
+	sfile.Seek(0, io.SeekStart)
+	td := make([]byte, len(expect))
+	if _, err := sfile.Read(td); err != nil {
+		t.Fatalf("Read: %s", err)
+	} else if !bytes.Equal(td, expect) {
+		t.Errorf("False data:\n\t%x\n\t%x", expect, td)
+	}
+	if _, err := sfile.Seek(-1, io.SeekStart); err != os.ErrInvalid {
+		t.Errorf("Seek before start: %v", err)
+	}
+}
+
+func TestStreamFileAt(t *testing.T) {
+	transform := new(TestTransform)
+	file := NewMemFile()
+	defer file.Close()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	sfile.SetCacheSize(4)
+	d := make([]byte, 1000)
+	for i := range d {
+		d[i] = byte(i * 7)
+	}
+	if n, err := sfile.WriteAt(d, 0); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	} else if n != len(d) {
+		t.Errorf("WriteAt length mismatch: %d!=%d", n, len(d))
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			td := make([]byte, 100)
+			if _, err := sfile.ReadAt(td, int64(off)); err != nil {
+				t.Errorf("ReadAt %d: %s", off, err)
+			} else if !bytes.Equal(td, d[off:off+100]) {
+				t.Errorf("False data %d:\n\t%x\n\t%x", off, d[off:off+100], td)
+			}
+		}(i * 45)
+	}
+	wg.Wait()
+	td := make([]byte, 100)
+	if n, err := sfile.ReadAt(td, 990); err != io.EOF {
+		t.Errorf("ReadAt past end: %v", err)
+	} else if n != 34 {
+		t.Errorf("ReadAt past end length: %d!=%d", n, 34)
+	}
+}
+
+type truncateTransform struct {
+	TestTransform
+	blocks int64
+}
+
+func (ttf *truncateTransform) Truncate(n int64) error {
+	ttf.blocks = n
+	return nil
+}
+
+func TestStreamFileTruncate(t *testing.T) {
+	transform := new(truncateTransform)
+	file := NewMemFile()
+	defer file.Close()
+	bfile, err := NewBlockFile(file, transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	d := bytes.Repeat([]byte{0xff}, 160)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if err := sfile.Truncate(70); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if transform.blocks != 3 {
+		t.Errorf("Transform not notified: %d!=%d", transform.blocks, 3)
+	}
+	if size := file.Len(); size != int64(transform.HeaderSize()+3*transform.BlockSize()) {
+		t.Errorf("Wrong file size: %d", size)
+	}
+	expect := append(d[:70:70], make([]byte, 26)...)
+	td := make([]byte, 100)
+	if n, err := sfile.ReadAt(td, 0); err != io.EOF {
+		t.Errorf("ReadAt past end: %v", err)
+	} else if !bytes.Equal(td[:n], expect) {
+		t.Errorf("False data:\n\t%x\n\t%x", expect, td[:n])
+	}
+	// Truncate to extend
+	if err := sfile.Truncate(200); err != nil {
+		t.Fatalf("Truncate extend: %s", err)
+	}
+	if pos, err := sfile.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %s", err)
+	} else if pos != 224 {
+		t.Errorf("Wrong size after extend: %d!=%d", pos, 224)
+	}
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 7 {
+		t.Errorf("Wrong stored blocks after extend: %d!=%d", n, 7)
+	}
+	if err := sfile.Truncate(0); err != nil {
+		t.Fatalf("Truncate 0: %s", err)
+	}
+	if n, err := sfile.ReadAt(td, 0); err != io.EOF || n != 0 {
+		t.Errorf("ReadAt empty: %d %v", n, err)
+	}
+}
+
+// lengthTransform stores the length of the file in the first 8 bytes of the header.
+type lengthTransform struct {
+	TestTransform
+	length atomic.Int64
+}
+
+func (ttf *lengthTransform) Init(d []byte) error {
+	ttf.length.Store(-1)
+	if len(d) >= 8 {
+		ttf.length.Store(int64(binary.BigEndian.Uint64(d)))
+	}
+	return nil
+}
+
+func (ttf *lengthTransform) SyncHeader() ([]byte, error) {
+	h, _ := ttf.TestTransform.SyncHeader()
+	binary.BigEndian.PutUint64(h, uint64(ttf.length.Load()))
+	return h, nil
+}
+
+func (ttf *lengthTransform) Length() int64 {
+	return ttf.length.Load()
+}
+
+func (ttf *lengthTransform) SetLength(n int64) {
+	ttf.length.Store(n)
+}
+
+func TestStreamFileLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "length")
+	open := func() *StreamFile {
+		bfile, err := OpenBlockFile(path, new(lengthTransform), nil)
+		if err != nil {
+			t.Fatalf("NewBlockFile: %s", err)
+		}
+		return NewStreamFile(bfile)
+	}
+	sfile := open()
+	d := bytes.Repeat([]byte{0xff}, 90)
+	if _, err := sfile.Write(d); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Truncate(70); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	if pos, err := sfile.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %s", err)
+	} else if pos != 70 {
+		t.Errorf("Wrong size after truncate: %d!=%d", pos, 70)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	sfile = open()
+	defer sfile.Close()
+	td := make([]byte, 100)
+	if n, err := sfile.ReadAt(td, 0); err != io.EOF {
+		t.Errorf("ReadAt past end: %v", err)
+	} else if !bytes.Equal(td[:n], d[:70]) {
+		t.Errorf("False data:\n\t%x\n\t%x", d[:70], td[:n])
+	}
+	if pos, err := sfile.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %s", err)
+	} else if pos != 70 {
+		t.Errorf("Wrong size after reopen: %d!=%d", pos, 70)
+	}
+	if _, err := sfile.Write([]byte("tail")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if _, err := sfile.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %s", err)
+	}
+	var buf bytes.Buffer
+	expect := append(d[:70:70], "tail"...)
+	if _, err := sfile.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	} else if !bytes.Equal(buf.Bytes(), expect) {
+		t.Errorf("False data after write:\n\t%x\n\t%x", expect, buf.Bytes())
+	}
+}
+
+func TestStreamFileAllocs(t *testing.T) {
+	transform := new(inPlaceTransform)
+	files := memFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	defer sfile.Close()
+	sfile.SetCacheSize(4)
+	d := make([]byte, 32)
+	for i := int64(0); i < 64; i++ {
+		if _, err := sfile.WriteAt(d, i*32); err != nil {
+			t.Fatalf("WriteAt: %s", err)
+		}
+	}
+	var i int64
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := sfile.WriteAt(d, (i%64)*32); err != nil {
+			t.Fatalf("WriteAt: %s", err)
+		}
+		i++
+	})
+	if allocs != 0 {
+		t.Errorf("Allocations per block write: %.1f", allocs)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		if _, err := sfile.ReadAt(d, (i%64)*32); err != nil {
+			t.Fatalf("ReadAt: %s", err)
+		}
+		i += 7
+	})
+	if allocs != 0 {
+		t.Errorf("Allocations per block read: %.1f", allocs)
+	}
+}
+
+func BenchmarkStreamFileWriteAt(b *testing.B) {
+	sfile := NewStreamFile(benchmarkBlockFile(b))
+	defer sfile.Close()
+	d := make([]byte, sfile.datasize)
+	b.SetBytes(int64(len(d)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sfile.WriteAt(d, int64(i%1024)*sfile.datasize); err != nil {
+			b.Fatalf("WriteAt: %s", err)
+		}
+	}
+}
+
+func BenchmarkStreamFileReadAt(b *testing.B) {
+	sfile := NewStreamFile(benchmarkBlockFile(b))
+	defer sfile.Close()
+	d := make([]byte, sfile.datasize)
+	for i := int64(0); i < 1024; i++ {
+		if _, err := sfile.WriteAt(d, i*sfile.datasize); err != nil {
+			b.Fatalf("WriteAt: %s", err)
+		}
+	}
+	b.SetBytes(int64(len(d)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sfile.ReadAt(d, int64(i%1024)*sfile.datasize); err != nil {
+			b.Fatalf("ReadAt: %s", err)
+		}
+	}
+}
+
+func TestStreamFileSparse(t *testing.T) {
+	transform := new(TestTransform)
+	files := tempFiles(t, 1)
+	bfile, err := NewBlockFile(files[0], transform)
+	if err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	sfile := NewStreamFile(bfile)
+	if _, err := sfile.Write([]byte("start")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if _, err := sfile.Seek(1000, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %s", err)
+	}
+	if _, err := sfile.Write([]byte("end")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := sfile.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	file, err := os.OpenFile(files[0].Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	if bfile, err = NewBlockFile(file, transform); err != nil {
+		t.Fatalf("NewBlockFile: %s", err)
+	}
+	if n, err := bfile.NumBlocks(); err != nil {
+		t.Fatalf("NumBlocks: %s", err)
+	} else if n != 32 {
+		t.Errorf("NumBlocks: %d!=%d", n, 32)
+	}
+	sfile = NewStreamFile(bfile)
+	defer sfile.Close()
+	expect := make([]byte, 1003)
+	copy(expect, "start")
+	copy(expect[1000:], "end")
+	td := make([]byte, 1024)
+	if n, err := sfile.ReadAt(td, 0); err != nil {
+		t.Errorf("ReadAt: %s", err)
+	} else if !bytes.Equal(td[:1003], expect) || n != 1024 {
+		t.Errorf("False data %d:\n\t%x\n\t%x", n, expect, td[:n])
+	}
+}